@@ -0,0 +1,145 @@
+package gintonic
+
+import (
+	"context"
+	"fmt"
+	"gorm.io/gorm"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	HealthStatusUp   = "up"
+	HealthStatusDown = "down"
+
+	defaultCheckTimeout = 3 * time.Second
+)
+
+type HealthChecker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type CheckResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HealthRegistry runs named checkers concurrently, each bounded by the check timeout
+type HealthRegistry struct {
+	checkers []HealthChecker
+	timeout  time.Duration
+}
+
+func NewHealthRegistry(checkers ...HealthChecker) *HealthRegistry {
+	return &HealthRegistry{
+		checkers: checkers,
+		timeout:  defaultCheckTimeout,
+	}
+}
+
+func (r *HealthRegistry) Register(checker HealthChecker) *HealthRegistry {
+	r.checkers = append(r.checkers, checker)
+	return r
+}
+
+func (r *HealthRegistry) WithTimeout(timeout time.Duration) *HealthRegistry {
+	r.timeout = timeout
+	return r
+}
+
+func (r *HealthRegistry) Run(ctx context.Context) *HealthReport {
+	report := &HealthReport{
+		Status: HealthStatusUp,
+		Checks: make([]CheckResult, len(r.checkers)),
+	}
+
+	var wg sync.WaitGroup
+	for i, checker := range r.checkers {
+		wg.Add(1)
+		go func(i int, checker HealthChecker) {
+			defer wg.Done()
+			report.Checks[i] = r.check(ctx, checker)
+		}(i, checker)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status != HealthStatusUp {
+			report.Status = HealthStatusDown
+		}
+	}
+	return report
+}
+
+func (r *HealthRegistry) check(ctx context.Context, checker HealthChecker) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := checker.Check(ctx)
+	result := CheckResult{
+		Name:      checker.Name(),
+		Status:    HealthStatusUp,
+		LatencyMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = HealthStatusDown
+		result.Error = err.Error()
+	}
+	return result
+}
+
+type funcChecker struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+func CheckerFunc(name string, check func(ctx context.Context) error) HealthChecker {
+	return &funcChecker{name: name, check: check}
+}
+
+func (c *funcChecker) Name() string {
+	return c.name
+}
+
+func (c *funcChecker) Check(ctx context.Context) error {
+	return c.check(ctx)
+}
+
+func NewPostgresChecker(database *gorm.DB) HealthChecker {
+	return CheckerFunc("postgres", func(ctx context.Context) error {
+		db, err := database.DB()
+		if err != nil {
+			return err
+		}
+		return db.PingContext(ctx)
+	})
+}
+
+// NewHTTPChecker expects GET url to respond without an error status
+func NewHTTPChecker(name, url string) HealthChecker {
+	return CheckerFunc(name, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if isHttp, status := isHttpError(res); isHttp {
+			return fmt.Errorf("error %v", status)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,206 @@
+package gintonic
+
+import (
+	"context"
+	"errors"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newPingDB(t *testing.T, pingErr error) *gorm.DB {
+	sqlDB, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sqlDB.Close()
+	})
+	// gorm pings once when opening
+	mock.ExpectPing()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.ExpectPing().WillReturnError(pingErr)
+	return db
+}
+
+func TestHealthRegistry(t *testing.T) {
+	slow := func(name string) HealthChecker {
+		return CheckerFunc(name, func(ctx context.Context) error {
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	}
+	hanging := CheckerFunc("hanging", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	failing := CheckerFunc("failing", func(ctx context.Context) error {
+		return errors.New("connection refused")
+	})
+
+	tests := []struct {
+		name     string
+		registry *HealthRegistry
+		status   string
+		checks   []string
+	}{
+		{
+			name:     "No checkers",
+			registry: NewHealthRegistry(),
+			status:   HealthStatusUp,
+			checks:   []string{},
+		},
+		{
+			name:     "Checkers run concurrently",
+			registry: NewHealthRegistry(slow("first"), slow("second"), slow("third")),
+			status:   HealthStatusUp,
+			checks:   []string{HealthStatusUp, HealthStatusUp, HealthStatusUp},
+		},
+		{
+			name:     "Failing checker",
+			registry: NewHealthRegistry(slow("first")).Register(failing),
+			status:   HealthStatusDown,
+			checks:   []string{HealthStatusUp, HealthStatusDown},
+		},
+		{
+			name:     "Hanging checker times out",
+			registry: NewHealthRegistry(hanging).WithTimeout(20 * time.Millisecond),
+			status:   HealthStatusDown,
+			checks:   []string{HealthStatusDown},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			report := tt.registry.Run(context.Background())
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("TestHealthRegistry(): Run duration\ngot= \t%v\nwant = \t%v", elapsed, "under a second")
+			}
+			if elapsed := time.Since(start); len(report.Checks) > 1 && elapsed >= 100*time.Millisecond {
+				t.Errorf("TestHealthRegistry(): Run duration of concurrent checks\ngot= \t%v\nwant = \t%v", elapsed, "under 100ms")
+			}
+			if report.Status != tt.status {
+				t.Errorf("TestHealthRegistry(): status\ngot= \t%v\nwant = \t%v", report.Status, tt.status)
+			}
+			statuses := []string{}
+			for _, check := range report.Checks {
+				statuses = append(statuses, check.Status)
+				if (check.Error != "") != (check.Status == HealthStatusDown) {
+					t.Errorf("TestHealthRegistry(): error of %v\ngot= \t%v\nwant = \t%v", check.Name, check.Error, check.Status)
+				}
+			}
+			if len(statuses) != len(tt.checks) {
+				t.Fatalf("TestHealthRegistry(): checks\ngot= \t%v\nwant = \t%v", statuses, tt.checks)
+			}
+			for i := range statuses {
+				if statuses[i] != tt.checks[i] {
+					t.Errorf("TestHealthRegistry(): checks\ngot= \t%v\nwant = \t%v", statuses, tt.checks)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTPChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		healthy bool
+	}{
+		{name: "Healthy dependency", status: http.StatusNoContent, healthy: true},
+		{name: "Failing dependency", status: http.StatusServiceUnavailable, healthy: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			err := NewHTTPChecker("billing", server.URL).Check(context.Background())
+			if (err == nil) != tt.healthy {
+				t.Errorf("TestHTTPChecker(): Check\ngot= \t%v\nwant = \t%v", err, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestPostgresChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		pingErr error
+	}{
+		{name: "Reachable database"},
+		{name: "Unreachable database", pingErr: errors.New("connection refused")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewPostgresChecker(newPingDB(t, tt.pingErr)).Check(context.Background())
+			if (err != nil) != (tt.pingErr != nil) {
+				t.Errorf("TestPostgresChecker(): Check\ngot= \t%v\nwant = \t%v", err, tt.pingErr)
+			}
+		})
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	failing := CheckerFunc("billing", func(ctx context.Context) error {
+		return errors.New("connection refused")
+	})
+
+	tests := []struct {
+		name   string
+		setup  func(t *testing.T, router *gin.Engine)
+		status int
+	}{
+		{
+			name: "Database is up",
+			setup: func(t *testing.T, router *gin.Engine) {
+				AddHealthChecks(router, newPingDB(t, nil))
+			},
+			status: http.StatusNoContent,
+		},
+		{
+			name: "Database is down",
+			setup: func(t *testing.T, router *gin.Engine) {
+				AddHealthChecks(router, newPingDB(t, errors.New("connection refused")))
+			},
+			status: http.StatusInternalServerError,
+		},
+		{
+			name: "Registry is up",
+			setup: func(t *testing.T, router *gin.Engine) {
+				AddHealthChecksWithRegistry(router, NewHealthRegistry(NewPostgresChecker(newPingDB(t, nil))))
+			},
+			status: http.StatusOK,
+		},
+		{
+			name: "Registry is down",
+			setup: func(t *testing.T, router *gin.Engine) {
+				AddHealthChecksWithRegistry(router, NewHealthRegistry(NewPostgresChecker(newPingDB(t, nil)), failing))
+			},
+			status: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			tt.setup(t, router)
+
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/checks/readiness", nil))
+			if recorder.Code != tt.status {
+				t.Errorf("TestReadiness(): status\ngot= \t%v\nwant = \t%v", recorder.Code, tt.status)
+			}
+		})
+	}
+}
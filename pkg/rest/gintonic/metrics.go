@@ -0,0 +1,13 @@
+package gintonic
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// AddMetrics exposes the metrics of gatherer in prometheus format,
+// prometheus.DefaultGatherer includes everything registered globally
+func AddMetrics(router *gin.Engine, gatherer prometheus.Gatherer) {
+	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
+}
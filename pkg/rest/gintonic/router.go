@@ -14,6 +14,16 @@ func AddHealthChecks(router *gin.Engine, database *gorm.DB) {
 	}
 }
 
+// AddHealthChecksWithRegistry reports every registered checker on readiness,
+// responding 200 with the report when all are up and 503 otherwise
+func AddHealthChecksWithRegistry(router *gin.Engine, registry *HealthRegistry) {
+	checkRoutes := router.Group("/checks")
+	{
+		checkRoutes.GET("/healthz", healthz())
+		checkRoutes.GET("/readiness", readinessReport(registry))
+	}
+}
+
 func AddHealthChecksNoDB(router *gin.Engine) {
 	checkRoutes := router.Group("/checks")
 	{
@@ -44,3 +54,15 @@ func readiness(database *gorm.DB) gin.HandlerFunc {
 		c.JSON(http.StatusNoContent, nil)
 	}
 }
+
+func readinessReport(registry *HealthRegistry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report := registry.Run(c.Request.Context())
+		if report.Status != HealthStatusUp {
+			c.JSON(http.StatusServiceUnavailable, report)
+			return
+		}
+
+		c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,442 @@
+package messaging
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	AvroContentType = "avro/binary"
+)
+
+var (
+	ErrAvroUnsupported = errors.New("type has no avro representation")
+
+	timeType = reflect.TypeOf(time.Time{})
+)
+
+// AvroSchema is the schema of the avro payloads of event, consumers written in other
+// languages decode payloads with it. Events are records named after their struct,
+// their fields are named like encoding/json names them, pointers are nullable and
+// times are timestamp-micros.
+func AvroSchema(event interface{}) (string, error) {
+	typ := reflect.TypeOf(event)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return "", fmt.Errorf("%w: %T is not a struct", ErrAvroUnsupported, event)
+	}
+	schema, err := avroSchemaOf(typ, map[reflect.Type]bool{})
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+type avroCodec struct{}
+
+func (avroCodec) ContentType() string {
+	return AvroContentType
+}
+
+func (avroCodec) Encode(event interface{}) ([]byte, error) {
+	v := reflect.ValueOf(event)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%w: %T is not a struct", ErrAvroUnsupported, event)
+	}
+	return appendAvro(nil, v)
+}
+
+func (avroCodec) Decode(data []byte, event interface{}) error {
+	v := reflect.ValueOf(event)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%w: %T is not a pointer to a struct", ErrAvroUnsupported, event)
+	}
+	r := &avroReader{data: data}
+	if err := r.read(v.Elem()); err != nil {
+		return err
+	}
+	if r.pos != len(r.data) {
+		return fmt.Errorf("%v trailing bytes after avro record", len(r.data)-r.pos)
+	}
+	return nil
+}
+
+type avroField struct {
+	name  string
+	index []int
+	typ   reflect.Type
+}
+
+// avroFields follows encoding/json naming, fields of embedded structs are promoted
+func avroFields(typ reflect.Type, index []int) []avroField {
+	var fields []avroField
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int{}, index...), i)
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, avroFields(field.Type, fieldIndex)...)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, avroField{name: name, index: fieldIndex, typ: field.Type})
+	}
+	return fields
+}
+
+// avroSchemaOf describes typ, records already defined are referred to by name
+func avroSchemaOf(typ reflect.Type, defined map[reflect.Type]bool) (interface{}, error) {
+	if typ == timeType {
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-micros"}, nil
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return "int", nil
+	case reflect.Int, reflect.Int64, reflect.Uint32:
+		return "long", nil
+	case reflect.Float32:
+		return "float", nil
+	case reflect.Float64:
+		return "double", nil
+	case reflect.String:
+		return "string", nil
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return "bytes", nil
+		}
+		items, err := avroSchemaOf(typ.Elem(), defined)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			break
+		}
+		values, err := avroSchemaOf(typ.Elem(), defined)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "map", "values": values}, nil
+	case reflect.Ptr:
+		schema, err := avroSchemaOf(typ.Elem(), defined)
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{"null", schema}, nil
+	case reflect.Struct:
+		if typ.Name() == "" {
+			break
+		}
+		if defined[typ] {
+			return typ.Name(), nil
+		}
+		defined[typ] = true
+		var fields []interface{}
+		for _, field := range avroFields(typ, nil) {
+			schema, err := avroSchemaOf(field.typ, defined)
+			if err != nil {
+				return nil, fmt.Errorf("field %v of %v: %w", field.name, typ.Name(), err)
+			}
+			fields = append(fields, map[string]interface{}{"name": field.name, "type": schema})
+		}
+		return map[string]interface{}{"type": "record", "name": typ.Name(), "fields": fields}, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAvroUnsupported, typ)
+}
+
+func appendAvro(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		return appendLong(buf, v.Interface().(time.Time).UnixMicro()), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendLong(buf, v.Int()), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return appendLong(buf, int64(v.Uint())), nil
+	case reflect.Float32:
+		return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return append(appendLong(buf, int64(v.Len())), v.String()...), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(appendLong(buf, int64(v.Len())), v.Bytes()...), nil
+		}
+		// a single block of items followed by the empty block ending arrays
+		if v.Len() > 0 {
+			buf = appendLong(buf, int64(v.Len()))
+		}
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if buf, err = appendAvro(buf, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return appendLong(buf, 0), nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		// sorted so equal maps encode the same
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			buf = appendLong(buf, int64(len(keys)))
+		}
+		for _, key := range keys {
+			var err error
+			buf = append(appendLong(buf, int64(len(key))), key...)
+			if buf, err = appendAvro(buf, v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key()))); err != nil {
+				return nil, err
+			}
+		}
+		return appendLong(buf, 0), nil
+	case reflect.Ptr:
+		// unions are written as the index of their branch, null comes first
+		if v.IsNil() {
+			return appendLong(buf, 0), nil
+		}
+		return appendAvro(appendLong(buf, 1), v.Elem())
+	case reflect.Struct:
+		for _, field := range avroFields(v.Type(), nil) {
+			var err error
+			if buf, err = appendAvro(buf, v.FieldByIndex(field.index)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("%w: %v", ErrAvroUnsupported, v.Type())
+}
+
+// appendLong writes a zig-zag encoded variable length integer
+func appendLong(buf []byte, n int64) []byte {
+	return binary.AppendUvarint(buf, uint64((n<<1)^(n>>63)))
+}
+
+type avroReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *avroReader) read(v reflect.Value) error {
+	if v.Type() == timeType {
+		micros, err := r.long()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(time.UnixMicro(micros).UTC()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := r.next(1)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b[0] != 0)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("avro value %v overflows %v", n, v.Type())
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		n, err := r.long()
+		if err != nil {
+			return err
+		}
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return fmt.Errorf("avro value %v overflows %v", n, v.Type())
+		}
+		v.SetUint(uint64(n))
+		return nil
+	case reflect.Float32:
+		b, err := r.next(4)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))))
+		return nil
+	case reflect.Float64:
+		b, err := r.next(8)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(binary.LittleEndian.Uint64(b)))
+		return nil
+	case reflect.String:
+		b, err := r.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		slice := reflect.MakeSlice(v.Type(), 0, 0)
+		err := r.blocks(func() error {
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := r.read(item); err != nil {
+				return err
+			}
+			slice = reflect.Append(slice, item)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(slice)
+		return nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := reflect.MakeMap(v.Type())
+		err := r.blocks(func() error {
+			key, err := r.bytes()
+			if err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err = r.read(value); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(m)
+		return nil
+	case reflect.Ptr:
+		branch, err := r.long()
+		if err != nil {
+			return err
+		}
+		switch branch {
+		case 0:
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		case 1:
+			elem := reflect.New(v.Type().Elem())
+			if err = r.read(elem.Elem()); err != nil {
+				return err
+			}
+			v.Set(elem)
+			return nil
+		}
+		return fmt.Errorf("avro union of %v has no branch %v", v.Type(), branch)
+	case reflect.Struct:
+		for _, field := range avroFields(v.Type(), nil) {
+			if err := r.read(v.FieldByIndex(field.index)); err != nil {
+				return fmt.Errorf("field %v of %v: %w", field.name, v.Type().Name(), err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrAvroUnsupported, v.Type())
+}
+
+// blocks reads the blocks of an array or a map, a negative count is followed by the block size
+func (r *avroReader) blocks(item func() error) error {
+	for {
+		count, err := r.long()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			count = -count
+			if _, err = r.long(); err != nil {
+				return err
+			}
+		}
+		for ; count > 0; count-- {
+			if err = item(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *avroReader) long() (int64, error) {
+	n, size := binary.Uvarint(r.data[r.pos:])
+	if size <= 0 {
+		return 0, errors.New("malformed avro long")
+	}
+	r.pos += size
+	return int64(n>>1) ^ -int64(n&1), nil
+}
+
+func (r *avroReader) bytes() ([]byte, error) {
+	size, err := r.long()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("negative avro length %v", size)
+	}
+	return r.next(int(size))
+}
+
+func (r *avroReader) next(size int) ([]byte, error) {
+	if size > len(r.data)-r.pos {
+		return nil, errors.New("avro payload is truncated")
+	}
+	b := r.data[r.pos : r.pos+size]
+	r.pos += size
+	return b, nil
+}
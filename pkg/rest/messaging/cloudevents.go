@@ -0,0 +1,174 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+const (
+	CloudEventsSpecVersion = "1.0"
+	// CloudEventsContentType marks structured mode events
+	CloudEventsContentType = "application/cloudevents+json"
+	JSONContentType        = "application/json"
+
+	ExtensionActorID     = "actorid"
+	ExtensionReceiverIDs = "receiverids"
+	ExtensionSentAt      = "sentat"
+)
+
+var cloudEventAttributes = []string{"specversion", "id", "source", "type", "subject", "time", "datacontenttype", "data"}
+
+// CloudEvent is a CloudEvents 1.0 envelope, extensions are serialized as top level attributes
+type CloudEvent struct {
+	SpecVersion     string            `json:"specversion"`
+	ID              string            `json:"id"`
+	Source          string            `json:"source"`
+	Type            string            `json:"type"`
+	Subject         string            `json:"subject,omitempty"`
+	Time            *time.Time        `json:"time,omitempty"`
+	DataContentType string            `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage   `json:"data,omitempty"`
+	Extensions      map[string]string `json:"-"`
+}
+
+// NewCloudEvent wraps a JSON event, its type becomes the event type and the
+// Baggage it embeds is carried by the actorid, receiverids and sentat extensions
+func NewCloudEvent(source, subject string, data []byte) (*CloudEvent, error) {
+	var envelope struct {
+		Type string `json:"type"`
+		Baggage
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return nil, err
+	}
+	if envelope.Type == "" {
+		return nil, fmt.Errorf("missing key [type] in %v", string(data))
+	}
+
+	now := time.Now().UTC()
+	if !envelope.SentAt.IsZero() {
+		now = envelope.SentAt.Time
+	}
+	return &CloudEvent{
+		SpecVersion:     CloudEventsSpecVersion,
+		ID:              uuid.New().String(),
+		Source:          source,
+		Type:            envelope.Type,
+		Subject:         subject,
+		Time:            &now,
+		DataContentType: JSONContentType,
+		Data:            data,
+		Extensions:      envelope.Baggage.ToExtensions(),
+	}, nil
+}
+
+// IsStructuredCloudEvent tells whether data is a CloudEvent in structured mode
+func IsStructuredCloudEvent(data []byte) bool {
+	var envelope struct {
+		SpecVersion string `json:"specversion"`
+	}
+	return json.Unmarshal(data, &envelope) == nil && envelope.SpecVersion != ""
+}
+
+func (e *CloudEvent) Baggage() (*Baggage, error) {
+	return BaggageFromExtensions(e.Extensions)
+}
+
+func (e CloudEvent) MarshalJSON() ([]byte, error) {
+	type attributes CloudEvent
+	data, err := json.Marshal(attributes(e))
+	if err != nil || len(e.Extensions) == 0 {
+		return data, err
+	}
+
+	var result map[string]json.RawMessage
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	for name, value := range e.Extensions {
+		if containsField(cloudEventAttributes, name) {
+			continue
+		}
+		if result[name], err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(result)
+}
+
+func (e *CloudEvent) UnmarshalJSON(data []byte) error {
+	type attributes CloudEvent
+	if err := json.Unmarshal(data, (*attributes)(e)); err != nil {
+		return err
+	}
+	if e.SpecVersion != CloudEventsSpecVersion {
+		return fmt.Errorf("unsupported cloudevents spec version %v", e.SpecVersion)
+	}
+
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	e.Extensions = map[string]string{}
+	for name, raw := range all {
+		if containsField(cloudEventAttributes, name) {
+			continue
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			// extensions of other types are kept in their JSON form
+			value = string(raw)
+		}
+		e.Extensions[name] = value
+	}
+	return nil
+}
+
+func (b Baggage) ToExtensions() map[string]string {
+	extensions := map[string]string{}
+	if b.ActorID != nil {
+		extensions[ExtensionActorID] = b.ActorID.String()
+	}
+	if len(b.ReceiverIDs) != 0 {
+		receivers := make([]string, len(b.ReceiverIDs))
+		for i, id := range b.ReceiverIDs {
+			receivers[i] = id.String()
+		}
+		extensions[ExtensionReceiverIDs] = strings.Join(receivers, ",")
+	}
+	if !b.SentAt.IsZero() {
+		extensions[ExtensionSentAt] = b.SentAt.Format(timeNanoFormat)
+	}
+	return extensions
+}
+
+func BaggageFromExtensions(extensions map[string]string) (*Baggage, error) {
+	baggage := &Baggage{}
+	if actor, ok := extensions[ExtensionActorID]; ok {
+		actorID, err := uuid.Parse(actor)
+		if err != nil {
+			return nil, InvalidField{Name: ExtensionActorID, Format: "uuid"}
+		}
+		baggage.ActorID = &actorID
+	}
+	if receivers, ok := extensions[ExtensionReceiverIDs]; ok && receivers != "" {
+		for _, receiver := range strings.Split(receivers, ",") {
+			receiverID, err := uuid.Parse(receiver)
+			if err != nil {
+				return nil, InvalidField{Name: ExtensionReceiverIDs, Format: "uuid"}
+			}
+			baggage.ReceiverIDs = append(baggage.ReceiverIDs, receiverID)
+		}
+	}
+	if sentAt, ok := extensions[ExtensionSentAt]; ok {
+		parsed, err := ParseNano3339Time(sentAt)
+		if err != nil {
+			return nil, InvalidField{Name: ExtensionSentAt, Format: timeNanoFormat}
+		}
+		baggage.SentAt = *parsed
+	}
+	return baggage, nil
+}
@@ -0,0 +1,166 @@
+package messaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	ProtobufContentType = "application/x-protobuf"
+
+	gzipSuffix = "+gzip"
+)
+
+var (
+	JSON     Codec = jsonCodec{}
+	Protobuf Codec = protobufCodec{}
+	// Avro writes events in the avro binary encoding, readers decode them with AvroSchema
+	Avro Codec = avroCodec{}
+
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	for _, codec := range []Codec{JSON, Protobuf, Avro} {
+		RegisterCodec(codec)
+		RegisterCodec(Gzip(codec))
+	}
+}
+
+// Codec turns events into message payloads of its content type and back
+type Codec interface {
+	ContentType() string
+	Encode(event interface{}) ([]byte, error)
+	Decode(data []byte, event interface{}) error
+}
+
+// RegisterCodec makes codec available to CodecFor, replacing one of the same content type
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[codec.ContentType()] = codec
+}
+
+// CodecFor looks up the codec of a content type, payloads without one are JSON
+func CodecFor(contentType string) (Codec, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[contentType]
+	if ok {
+		return codec, nil
+	}
+	if IsJSONContentType(contentType) {
+		// JSON flavours such as cloud events
+		if strings.HasSuffix(contentType, gzipSuffix) {
+			return Gzip(JSON), nil
+		}
+		return JSON, nil
+	}
+	return nil, fmt.Errorf("no codec for content type %v", contentType)
+}
+
+// IsJSONContentType tells whether payloads of contentType decode to JSON, possibly after decompression
+func IsJSONContentType(contentType string) bool {
+	base := strings.TrimSuffix(contentType, gzipSuffix)
+	return base == "" || base == JSONContentType || base == CloudEventsContentType
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return JSONContentType
+}
+
+func (jsonCodec) Encode(event interface{}) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func (jsonCodec) Decode(data []byte, event interface{}) error {
+	return json.Unmarshal(data, event)
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return ProtobufContentType
+}
+
+func (protobufCodec) Encode(event interface{}) ([]byte, error) {
+	message, ok := event.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a protobuf message", event)
+	}
+	return proto.Marshal(message)
+}
+
+func (protobufCodec) Decode(data []byte, event interface{}) error {
+	message, ok := event.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%T is not a protobuf message", event)
+	}
+	return proto.Unmarshal(data, message)
+}
+
+type gzipCodec struct {
+	codec Codec
+}
+
+// Gzip compresses the payloads of codec, its content type gets a +gzip suffix
+func Gzip(codec Codec) Codec {
+	return gzipCodec{codec: codec}
+}
+
+func (c gzipCodec) ContentType() string {
+	return CompressedContentType(c.codec.ContentType())
+}
+
+func CompressedContentType(contentType string) string {
+	return contentType + gzipSuffix
+}
+
+func (c gzipCodec) Encode(event interface{}) ([]byte, error) {
+	data, err := c.codec.Encode(event)
+	if err != nil {
+		return nil, err
+	}
+	return Compress(data)
+}
+
+func (c gzipCodec) Decode(data []byte, event interface{}) error {
+	data, err := Decompress(data)
+	if err != nil {
+		return err
+	}
+	return c.codec.Decode(data, event)
+}
+
+func Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
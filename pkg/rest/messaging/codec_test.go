@@ -0,0 +1,189 @@
+package messaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewEventsFromPayload(t *testing.T) {
+	event := &orderPlaced{Type: "OrderPlaced", OrderID: "7", Note: "fragile"}
+	templates := map[string]EventsTemplate{
+		"OrderPlaced": {Template: &orderPlaced{}, Flatten: singleEvent},
+	}
+
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{name: "JSON", codec: JSON},
+		{name: "Avro", codec: Avro},
+		{name: "Compressed JSON", codec: Gzip(JSON)},
+		{name: "Compressed avro", codec: Gzip(Avro)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.codec.Encode(event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, err := NewEventsFromPayload(context.Background(), data, tt.codec.ContentType(), "OrderPlaced", templates)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(events, []interface{}{event}) {
+				t.Errorf("TestNewEventsFromPayload(): NewEventsFromPayload\ngot= \t%v\nwant = \t%v", events, event)
+			}
+		})
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	codec, err := CodecFor(CompressedContentType(ProtobufContentType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codec.Encode(wrapperspb.String("order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded := &wrapperspb.StringValue{}
+	if err = codec.Decode(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(decoded, wrapperspb.String("order")) {
+		t.Errorf("TestProtobufCodec(): Decode\ngot= \t%v\nwant = \t%v", decoded, "order")
+	}
+
+	if _, err = codec.Encode(orderPlaced{}); err == nil {
+		t.Errorf("TestProtobufCodec(): Encode of a non protobuf message\ngot= \t%v\nwant = \t%v", err, "an error")
+	}
+}
+
+type shipmentAudit struct {
+	CreatedBy string `json:"createdBy"`
+}
+
+type shipmentLine struct {
+	Sku      string `json:"sku"`
+	Quantity int32  `json:"quantity"`
+}
+
+type shipmentSent struct {
+	shipmentAudit
+	ID        int64            `json:"id"`
+	Weight    float64          `json:"weight"`
+	Ratio     float32          `json:"ratio"`
+	Express   bool             `json:"express"`
+	Courier   *string          `json:"courier"`
+	Insurer   *string          `json:"insurer"`
+	Label     []byte           `json:"label"`
+	Lines     []shipmentLine   `json:"lines"`
+	Sizes     map[string]int32 `json:"sizes"`
+	ShippedAt time.Time        `json:"shippedAt"`
+	internal  string
+}
+
+type invoiceIssued struct {
+	Total uint64 `json:"total"`
+}
+
+func TestAvroCodec(t *testing.T) {
+	courier := "DHL"
+	shipment := &shipmentSent{
+		shipmentAudit: shipmentAudit{CreatedBy: "jane"},
+		ID:            -42,
+		Weight:        12.5,
+		Ratio:         0.25,
+		Express:       true,
+		Courier:       &courier,
+		Label:         []byte{0x00, 0xff},
+		Lines:         []shipmentLine{{Sku: "A1", Quantity: 2}, {Sku: "B2", Quantity: 1}},
+		Sizes:         map[string]int32{"box": 3},
+		ShippedAt:     time.Date(2021, 6, 1, 12, 0, 0, 123456000, time.UTC),
+	}
+
+	tests := []struct {
+		name  string
+		event interface{}
+		want  interface{}
+		data  []byte
+	}{
+		{
+			// the avro spec writes strings as their zig-zag length followed by their bytes
+			name:  "Wire format",
+			event: &orderPlaced{Type: "OrderPlaced", OrderID: "7", Note: "fragile"},
+			want:  &orderPlaced{Type: "OrderPlaced", OrderID: "7", Note: "fragile"},
+			data:  []byte("\x16OrderPlaced\x027\x0efragile"),
+		},
+		{
+			name:  "Every supported type",
+			event: shipment,
+			want:  shipment,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := Avro.Encode(tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.data != nil && !bytes.Equal(data, tt.data) {
+				t.Errorf("TestAvroCodec(): Encode\ngot= \t%x\nwant = \t%x", data, tt.data)
+			}
+			decoded := reflect.New(reflect.TypeOf(tt.want).Elem()).Interface()
+			if err = Avro.Decode(data, decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.want) {
+				t.Errorf("TestAvroCodec(): Decode\ngot= \t%+v\nwant = \t%+v", decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvroSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		event  interface{}
+		schema string
+		err    error
+	}{
+		{
+			name:   "Record",
+			event:  &orderPlaced{},
+			schema: `{"fields":[{"name":"type","type":"string"},{"name":"orderId","type":"string"},{"name":"note","type":"string"}],"name":"orderPlaced","type":"record"}`,
+		},
+		{
+			name:  "Nested records, unions and logical types",
+			event: shipmentSent{},
+			schema: `{"fields":[{"name":"createdBy","type":"string"},{"name":"id","type":"long"},{"name":"weight","type":"double"},` +
+				`{"name":"ratio","type":"float"},{"name":"express","type":"boolean"},{"name":"courier","type":["null","string"]},` +
+				`{"name":"insurer","type":["null","string"]},{"name":"label","type":"bytes"},` +
+				`{"name":"lines","type":{"items":{"fields":[{"name":"sku","type":"string"},{"name":"quantity","type":"int"}],"name":"shipmentLine","type":"record"},"type":"array"}},` +
+				`{"name":"sizes","type":{"type":"map","values":"int"}},{"name":"shippedAt","type":{"logicalType":"timestamp-micros","type":"long"}}],` +
+				`"name":"shipmentSent","type":"record"}`,
+		},
+		{
+			name:  "Unsupported field",
+			event: &invoiceIssued{},
+			err:   ErrAvroUnsupported,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := AvroSchema(tt.event)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("AvroSchema() error = %v, want %v", err, tt.err)
+			}
+			if schema != tt.schema {
+				t.Errorf("TestAvroSchema(): AvroSchema\ngot= \t%v\nwant = \t%v", schema, tt.schema)
+			}
+		})
+	}
+}
@@ -9,6 +9,18 @@ type JSONConvertable interface {
 	ToJSON() (string, error)
 }
 
+// PartitionKeyed is optionally implemented by events which know their kafka key,
+// events sharing a key are kept in order on the same partition
+type PartitionKeyed interface {
+	PartitionKey() string
+}
+
+// HeadersProvider is optionally implemented by events carrying metadata,
+// such as content type or tenant, which is sent as kafka headers
+type HeadersProvider interface {
+	EventHeaders() map[string]string
+}
+
 func ConvertToJson(data interface{}) (string, error) {
 	result, err := json.Marshal(data)
 	if err != nil {
@@ -0,0 +1,316 @@
+package messaging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	TypeField    = "type"
+	VersionField = "version"
+)
+
+var (
+	// DefaultEventRegistry validates produced and consumed events of registered types when set
+	DefaultEventRegistry *EventRegistry
+
+	// envelopeFields may be present in any event even when its struct doesn't declare them
+	envelopeFields = []string{TypeField, VersionField, "trace"}
+
+	ErrUnregisteredEvent = errors.New("event type is not registered")
+)
+
+// Validator is optionally implemented by events with rules beyond their schema
+type Validator interface {
+	Validate() error
+}
+
+// Upcaster migrates the payload of an event from one version to the next
+type Upcaster func(payload map[string]interface{}) (map[string]interface{}, error)
+
+type SchemaViolation struct {
+	EventType string
+	Version   int
+	Reason    string
+}
+
+func (v SchemaViolation) Error() string {
+	return fmt.Sprintf("event %v v%v violates its schema: %v", v.EventType, v.Version, v.Reason)
+}
+
+// EventRegistry keeps the current version of each event type along with a schema derived
+// from its Go struct, fields without omitempty are required and unknown fields are rejected
+type EventRegistry struct {
+	mu     sync.RWMutex
+	events map[string]*eventSchema
+}
+
+type eventSchema struct {
+	eventType string
+	version   int
+	typ       reflect.Type
+	required  []string
+	known     map[string]bool
+	upcasters map[int]Upcaster
+}
+
+func NewEventRegistry() *EventRegistry {
+	return &EventRegistry{events: map[string]*eventSchema{}}
+}
+
+// Register declares template, a struct or a pointer to one, as the current version of eventType
+func (r *EventRegistry) Register(eventType string, version int, template interface{}) error {
+	typ := reflect.TypeOf(template)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return fmt.Errorf("template of event %v must be a struct, got %T", eventType, template)
+	}
+	if version < 1 {
+		return fmt.Errorf("version of event %v must be positive", eventType)
+	}
+
+	schema := &eventSchema{
+		eventType: eventType,
+		version:   version,
+		typ:       typ,
+		known:     map[string]bool{},
+		upcasters: map[int]Upcaster{},
+	}
+	collectFields(typ, schema)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if previous, ok := r.events[eventType]; ok {
+		schema.upcasters = previous.upcasters
+	}
+	r.events[eventType] = schema
+	return nil
+}
+
+// RegisterUpcaster migrates eventType payloads of version from to version from+1
+func (r *EventRegistry) RegisterUpcaster(eventType string, from int, upcaster Upcaster) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	schema, ok := r.events[eventType]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrUnregisteredEvent, eventType)
+	}
+	schema.upcasters[from] = upcaster
+	return nil
+}
+
+// Registered tells whether the payload is of a registered event type
+func (r *EventRegistry) Registered(data []byte) bool {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return false
+	}
+	_, ok := r.schemaOf(envelope.Type)
+	return ok
+}
+
+// ValidateOutgoing checks an event about to be produced and returns it stamped with the current version
+func (r *EventRegistry) ValidateOutgoing(data []byte) ([]byte, error) {
+	payload, schema, version, err := r.parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		version = schema.version
+	}
+	if version != schema.version {
+		return nil, SchemaViolation{
+			EventType: schema.eventType,
+			Version:   version,
+			Reason:    fmt.Sprintf("only the current version %v may be produced", schema.version),
+		}
+	}
+	if _, err = schema.decode(payload, version); err != nil {
+		return nil, err
+	}
+
+	payload[VersionField] = schema.version
+	return json.Marshal(payload)
+}
+
+// Decode upcasts the payload to the current version of its type and decodes it
+// into a freshly allocated struct, returned as a pointer
+func (r *EventRegistry) Decode(data []byte) (interface{}, error) {
+	payload, schema, version, err := r.upcast(data)
+	if err != nil {
+		return nil, err
+	}
+	return schema.decode(payload, version)
+}
+
+// decodeAs is Decode into a value of template's type, when it isn't the registered one
+// the validated payload is decoded into it instead
+func (r *EventRegistry) decodeAs(data []byte, template interface{}) (interface{}, error) {
+	payload, schema, version, err := r.upcast(data)
+	if err != nil {
+		return nil, err
+	}
+	event, err := schema.decode(payload, version)
+	if err != nil || reflect.TypeOf(event) == reflect.TypeOf(template) {
+		return event, err
+	}
+	payload[VersionField] = version
+	upcasted, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return newEvent(upcasted, schema.eventType, string(upcasted), template)
+}
+
+// upcast brings the payload to the current version of its type
+func (r *EventRegistry) upcast(data []byte) (map[string]interface{}, *eventSchema, int, error) {
+	payload, schema, version, err := r.parse(data)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if version == 0 {
+		// events produced before versioning
+		version = 1
+	}
+	if version > schema.version {
+		return nil, nil, 0, SchemaViolation{
+			EventType: schema.eventType,
+			Version:   version,
+			Reason:    fmt.Sprintf("newer than the registered version %v", schema.version),
+		}
+	}
+	for ; version < schema.version; version++ {
+		upcaster, ok := schema.upcasters[version]
+		if !ok {
+			return nil, nil, 0, SchemaViolation{
+				EventType: schema.eventType,
+				Version:   version,
+				Reason:    "no upcaster to the next version",
+			}
+		}
+		if payload, err = upcaster(payload); err != nil {
+			return nil, nil, 0, fmt.Errorf("failed upcasting event %v v%v: %w", schema.eventType, version, err)
+		}
+	}
+	return payload, schema, version, nil
+}
+
+func (r *EventRegistry) schemaOf(eventType string) (*eventSchema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schema, ok := r.events[eventType]
+	return schema, ok
+}
+
+// parse reads the type and version of an event, the version is zero when the event has none
+func (r *EventRegistry) parse(data []byte) (map[string]interface{}, *eventSchema, int, error) {
+	var payload map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, nil, 0, err
+	}
+
+	eventType, _ := payload[TypeField].(string)
+	schema, ok := r.schemaOf(eventType)
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("%w: %v", ErrUnregisteredEvent, eventType)
+	}
+
+	version := 0
+	if raw, ok := payload[VersionField]; ok {
+		number, ok := raw.(json.Number)
+		if !ok {
+			return nil, nil, 0, fmt.Errorf("version of event %v must be a number", eventType)
+		}
+		parsed, err := number.Int64()
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("version of event %v must be an integer", eventType)
+		}
+		version = int(parsed)
+	}
+	return payload, schema, version, nil
+}
+
+func (s *eventSchema) decode(payload map[string]interface{}, version int) (interface{}, error) {
+	for _, field := range s.required {
+		if _, ok := payload[field]; !ok {
+			return nil, SchemaViolation{EventType: s.eventType, Version: version, Reason: "missing field " + field}
+		}
+	}
+	strict := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if !s.known[k] && containsField(envelopeFields, k) {
+			continue
+		}
+		strict[k] = v
+	}
+	data, err := json.Marshal(strict)
+	if err != nil {
+		return nil, err
+	}
+
+	event := reflect.New(s.typ).Interface()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(event); err != nil {
+		return nil, SchemaViolation{EventType: s.eventType, Version: version, Reason: err.Error()}
+	}
+	if validator, ok := event.(Validator); ok {
+		if err = validator.Validate(); err != nil {
+			return nil, SchemaViolation{EventType: s.eventType, Version: version, Reason: err.Error()}
+		}
+	}
+	return event, nil
+}
+
+// collectFields follows encoding/json naming, fields of embedded structs are promoted
+func collectFields(typ reflect.Type, schema *eventSchema) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				collectFields(embedded, schema)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.known[name] = true
+		if !strings.Contains(options, "omitempty") {
+			schema.required = append(schema.required, name)
+		}
+	}
+}
+
+func containsField(fields []string, field string) bool {
+	for _, f := range fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
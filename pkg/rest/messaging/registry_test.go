@@ -0,0 +1,100 @@
+package messaging
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type userRenamed struct {
+	Type     string `json:"type"`
+	UserID   string `json:"userId"`
+	FullName string `json:"fullName"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
+func (e *userRenamed) Validate() error {
+	if e.FullName == "" {
+		return errors.New("fullName cannot be empty")
+	}
+	return nil
+}
+
+func TestEventRegistryDecode(t *testing.T) {
+	registry := NewEventRegistry()
+	if err := registry.Register("UserRenamed", 2, &userRenamed{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = registry.RegisterUpcaster("UserRenamed", 1, func(payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["fullName"] = payload["name"]
+		delete(payload, "name")
+		return payload, nil
+	})
+
+	tests := []struct {
+		name    string
+		data    string
+		want    *userRenamed
+		wantErr bool
+	}{
+		{
+			name: "Current version",
+			data: `{"type":"UserRenamed","version":2,"userId":"1","fullName":"Jane Doe","trace":{}}`,
+			want: &userRenamed{Type: "UserRenamed", UserID: "1", FullName: "Jane Doe"},
+		},
+		{
+			name: "Unversioned event is upcast",
+			data: `{"type":"UserRenamed","userId":"1","name":"Jane Doe"}`,
+			want: &userRenamed{Type: "UserRenamed", UserID: "1", FullName: "Jane Doe"},
+		},
+		{
+			name:    "Missing required field",
+			data:    `{"type":"UserRenamed","version":2,"fullName":"Jane Doe"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Unknown field",
+			data:    `{"type":"UserRenamed","version":2,"userId":"1","fullName":"Jane Doe","age":3}`,
+			wantErr: true,
+		},
+		{
+			name:    "Failing validator",
+			data:    `{"type":"UserRenamed","version":2,"userId":"1","fullName":""}`,
+			wantErr: true,
+		},
+		{
+			name:    "Newer version",
+			data:    `{"type":"UserRenamed","version":3,"userId":"1","fullName":"Jane Doe"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := registry.Decode([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TestEventRegistryDecode(): Decode\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEventRegistryValidateOutgoing(t *testing.T) {
+	registry := NewEventRegistry()
+	_ = registry.Register("UserRenamed", 2, userRenamed{})
+
+	got, err := registry.ValidateOutgoing([]byte(`{"type":"UserRenamed","userId":"1","fullName":"Jane Doe"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"fullName":"Jane Doe","type":"UserRenamed","userId":"1","version":2}`
+	if string(got) != want {
+		t.Errorf("TestEventRegistryValidateOutgoing(): ValidateOutgoing\ngot= \t%v\nwant = \t%v", string(got), want)
+	}
+
+	if _, err = registry.ValidateOutgoing([]byte(`{"type":"UserCreated"}`)); !errors.Is(err, ErrUnregisteredEvent) {
+		t.Errorf("TestEventRegistryValidateOutgoing(): ValidateOutgoing error\ngot= \t%v\nwant = \t%v", err, ErrUnregisteredEvent)
+	}
+}
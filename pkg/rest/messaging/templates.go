@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
 	"github.com/sirupsen/logrus"
+	"reflect"
 )
 
 var (
@@ -30,14 +31,36 @@ func NewEventFromTemplate(ctx context.Context, data []byte, eventTemplates map[s
 	return events[0], nil
 }
 
+// NewEventsFromTemplate decodes data by its type, CloudEvents in structured mode are unwrapped first
 func NewEventsFromTemplate(ctx context.Context, data []byte, eventTemplates map[string]EventsTemplate) ([]interface{}, error) {
+	return newEventsFromJSON(ctx, data, "", eventTemplates)
+}
+
+// newEventsFromJSON decodes data by its `type` field, defaultType types payloads which have none
+func newEventsFromJSON(ctx context.Context, data []byte, defaultType string, eventTemplates map[string]EventsTemplate) ([]interface{}, error) {
 	log := ctxlogrus.Extract(ctx)
 
+	if IsStructuredCloudEvent(data) {
+		var cloudEvent CloudEvent
+		if err := json.Unmarshal(data, &cloudEvent); err != nil {
+			return nil, err
+		}
+		data = cloudEvent.Data
+		defaultType = cloudEvent.Type
+	}
+
 	var objMap map[string]interface{}
 	err := json.Unmarshal(data, &objMap)
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := objMap["type"]; !ok && defaultType != "" {
+		// the payload of foreign cloud events and of events typed by headers doesn't repeat the type
+		objMap["type"] = defaultType
+		if data, err = json.Marshal(objMap); err != nil {
+			return nil, err
+		}
+	}
 
 	body := string(data)
 	log.WithFields(logrus.Fields{"kafkaEvent": data}).Debug("incoming data from kafka")
@@ -46,7 +69,7 @@ func NewEventsFromTemplate(ctx context.Context, data []byte, eventTemplates map[
 		if !ok {
 			return nil, fmt.Errorf("unknown event type %v", eventType)
 		}
-		concreteEvent, err := newEvent(data, eventType, body, event.Template)
+		concreteEvent, err := decodeEvent(data, eventType, body, event.Template)
 		if err != nil {
 			return nil, err
 		}
@@ -59,23 +82,129 @@ func NewEventsFromTemplate(ctx context.Context, data []byte, eventTemplates map[
 	return nil, fmt.Errorf("missing key [type] in %v", body)
 }
 
+// NewEventsFromPayload decodes data by its content type, JSON payloads go through NewEventsFromTemplate
+// with eventType used when they have no `type` field, while binary ones are decoded into the template
+// of eventType as they don't carry their type
+func NewEventsFromPayload(ctx context.Context, data []byte, contentType, eventType string, eventTemplates map[string]EventsTemplate) ([]interface{}, error) {
+	codec, err := CodecFor(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if IsJSONContentType(contentType) {
+		var raw json.RawMessage
+		if err = codec.Decode(data, &raw); err != nil {
+			return nil, err
+		}
+		return newEventsFromJSON(ctx, raw, eventType, eventTemplates)
+	}
+
+	event, ok := eventTemplates[eventType]
+	if !ok {
+		return nil, fmt.Errorf("unknown event type %v", eventType)
+	}
+	concreteEvent, err := allocate(eventType, event.Template)
+	if err != nil {
+		return nil, err
+	}
+	if err = codec.Decode(data, concreteEvent); err != nil {
+		return nil, fmt.Errorf("failed to decode %v event of type %v because %v", contentType, eventType, err)
+	}
+	resultingEvents := event.Flatten(concreteEvent)
+	if resultingEvents == nil {
+		return nil, ErrFlatteningFailed
+	}
+	return resultingEvents, nil
+}
+
 func templateToTemplates(eventTemplates map[string]EventTemplate) map[string]EventsTemplate {
 	list := make(map[string]EventsTemplate, len(eventTemplates))
 	for k, v := range eventTemplates {
 		list[k] = EventsTemplate{
 			Template: v.Template,
-			Flatten: func(data interface{}) []interface{} {
-				return []interface{}{data}
-			},
+			Flatten:  singleEvent,
 		}
 	}
 	return list
 }
 
+func singleEvent(data interface{}) []interface{} {
+	return []interface{}{data}
+}
+
+// decodeEvent goes through DefaultEventRegistry when the event type is registered,
+// validating the payload and upcasting old versions before decoding into the template
+func decodeEvent(data []byte, eventType interface{}, body string, template interface{}) (interface{}, error) {
+	if DefaultEventRegistry != nil && DefaultEventRegistry.Registered(data) {
+		if _, err := allocate(eventType, template); err != nil {
+			return nil, err
+		}
+		return DefaultEventRegistry.decodeAs(data, template)
+	}
+	return newEvent(data, eventType, body, template)
+}
+
+// newEvent decodes into a fresh value of the template's type, the template itself is never written
+// so templates may be shared between consumers
 func newEvent(data []byte, eventType interface{}, body string, template interface{}) (interface{}, error) {
-	if err := json.Unmarshal(data, template); err != nil {
+	event, err := allocate(eventType, template)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, event); err != nil {
 		return nil, fmt.Errorf(
 			"failed to decode userEvent of type %v with value %v because %v", eventType, body, err)
 	}
-	return template, nil
+	return event, nil
+}
+
+func allocate(eventType interface{}, template interface{}) (interface{}, error) {
+	typ := reflect.TypeOf(template)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("template of event type %v must be a pointer, got %T", eventType, template)
+	}
+	return reflect.New(typ.Elem()).Interface(), nil
+}
+
+// TemplateOf is the template of events decoded into *T
+func TemplateOf[T any]() EventTemplate {
+	return EventTemplate{Template: new(T)}
+}
+
+// EventDecoder holds the templates of the event types it decodes
+type EventDecoder struct {
+	templates map[string]EventsTemplate
+}
+
+func NewEventDecoder() *EventDecoder {
+	return &EventDecoder{templates: map[string]EventsTemplate{}}
+}
+
+// Register decodes events of eventType into *T
+func Register[T any](d *EventDecoder, eventType string) *EventDecoder {
+	d.templates[eventType] = EventsTemplate{
+		Template: new(T),
+		Flatten:  singleEvent,
+	}
+	return d
+}
+
+func (d *EventDecoder) Decode(ctx context.Context, data []byte) (interface{}, error) {
+	events, err := NewEventsFromTemplate(ctx, data, d.templates)
+	if err != nil {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+// DecodeEvent decodes data expecting an event registered as T
+func DecodeEvent[T any](ctx context.Context, d *EventDecoder, data []byte) (*T, error) {
+	event, err := d.Decode(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	typed, ok := event.(*T)
+	if !ok {
+		return nil, fmt.Errorf("decoded event is %T instead of %T", event, typed)
+	}
+	return typed, nil
 }
@@ -0,0 +1,123 @@
+package messaging
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type orderPlaced struct {
+	Type    string `json:"type"`
+	OrderID string `json:"orderId"`
+	Note    string `json:"note,omitempty"`
+}
+
+func TestNewEventFromTemplateDoesNotShareValues(t *testing.T) {
+	template := &orderPlaced{}
+	templates := map[string]EventTemplate{"OrderPlaced": {Template: template}}
+
+	first, err := NewEventFromTemplate(context.Background(), []byte(`{"type":"OrderPlaced","orderId":"1","note":"fragile"}`), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewEventFromTemplate(context.Background(), []byte(`{"type":"OrderPlaced","orderId":"2"}`), templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{name: "First event is kept", got: first, want: &orderPlaced{Type: "OrderPlaced", OrderID: "1", Note: "fragile"}},
+		{name: "Second event has no leaked fields", got: second, want: &orderPlaced{Type: "OrderPlaced", OrderID: "2"}},
+		{name: "Template is untouched", got: template, want: &orderPlaced{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !reflect.DeepEqual(tt.got, tt.want) {
+				t.Errorf("NewEventFromTemplate()\ngot= \t%v\nwant = \t%v", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEventConcurrently(t *testing.T) {
+	decoder := Register[orderPlaced](NewEventDecoder(), "OrderPlaced")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			event, err := DecodeEvent[orderPlaced](context.Background(), decoder, []byte(`{"type":"OrderPlaced","orderId":"`+id+`"}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if event.OrderID != id {
+				t.Errorf("DecodeEvent() orderId got= %v, want %v", event.OrderID, id)
+			}
+		}(string(rune('a' + i%26)))
+	}
+	wg.Wait()
+}
+
+type userRenamedView struct {
+	Type     string `json:"type"`
+	Version  int    `json:"version"`
+	FullName string `json:"fullName"`
+}
+
+func TestNewEventFromTemplateRegistered(t *testing.T) {
+	registry := NewEventRegistry()
+	if err := registry.Register("UserRenamed", 2, &userRenamed{}); err != nil {
+		t.Fatal(err)
+	}
+	_ = registry.RegisterUpcaster("UserRenamed", 1, func(payload map[string]interface{}) (map[string]interface{}, error) {
+		payload["fullName"] = payload["name"]
+		delete(payload, "name")
+		return payload, nil
+	})
+	DefaultEventRegistry = registry
+	defer func() {
+		DefaultEventRegistry = nil
+	}()
+	data := []byte(`{"type":"UserRenamed","userId":"1","name":"Jane Doe"}`)
+
+	tests := []struct {
+		name     string
+		template interface{}
+		want     interface{}
+		wantErr  bool
+	}{
+		{
+			name:     "Registered type",
+			template: &userRenamed{},
+			want:     &userRenamed{Type: "UserRenamed", UserID: "1", FullName: "Jane Doe"},
+		},
+		{
+			name:     "Caller's own type",
+			template: &userRenamedView{},
+			want:     &userRenamedView{Type: "UserRenamed", Version: 2, FullName: "Jane Doe"},
+		},
+		{
+			name:     "Template is not a pointer",
+			template: userRenamedView{},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewEventFromTemplate(context.Background(), data, map[string]EventTemplate{"UserRenamed": {Template: tt.template}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewEventFromTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TestNewEventFromTemplateRegistered(): NewEventFromTemplate\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
@@ -9,8 +10,18 @@ type KafkaConfig struct {
 	Username string
 	Password string
 	SslMode  string
+	// AssignmentStrategy such as cooperative-sticky, empty keeps the client default
+	AssignmentStrategy string
+	// EnableIdempotence stops producer retries from duplicating messages
+	EnableIdempotence bool
+	// TransactionalID identifies a transactional producer across restarts, it must be unique per instance
+	TransactionalID string
 }
 
+var (
+	ErrMissingTransactionalID = errors.New("transactional id is neither given nor set by KAFKA_TRANSACTIONAL_ID")
+)
+
 func NewKafkaConfig() (*KafkaConfig, error) {
 
 	envKafkaHost, err := GetEnv("KAFKA_HOST")
@@ -35,11 +46,28 @@ func NewKafkaConfig() (*KafkaConfig, error) {
 		}
 	}
 
+	envKafkaAssignmentStrategy, err := GetEnvWithDefault("KAFKA_ASSIGNMENT_STRATEGY", "")
+	if err != nil {
+		return nil, err
+	}
+
+	envKafkaEnableIdempotence, err := GetEnvBoolWithDefault("KAFKA_ENABLE_IDEMPOTENCE", false)
+	if err != nil {
+		return nil, err
+	}
+	envKafkaTransactionalID, err := GetEnvWithDefault("KAFKA_TRANSACTIONAL_ID", "")
+	if err != nil {
+		return nil, err
+	}
+
 	return &KafkaConfig{
-		Host:     envKafkaHost,
-		Username: envKafkaUsername,
-		Password: envKafkaPassword,
-		SslMode:  envKafkaSslMode,
+		Host:               envKafkaHost,
+		Username:           envKafkaUsername,
+		Password:           envKafkaPassword,
+		SslMode:            envKafkaSslMode,
+		AssignmentStrategy: envKafkaAssignmentStrategy,
+		EnableIdempotence:  envKafkaEnableIdempotence,
+		TransactionalID:    envKafkaTransactionalID,
 	}, nil
 }
 
@@ -48,6 +76,9 @@ func (cfg *KafkaConfig) GetKafkaConfigMapConsumer(clientID, consumerGroup string
 	result["client.id"] = clientID
 	result["group.id"] = consumerGroup
 	result["enable.auto.commit"] = false
+	if cfg.AssignmentStrategy != "" {
+		result["partition.assignment.strategy"] = cfg.AssignmentStrategy
+	}
 	return &result
 }
 
@@ -58,6 +89,31 @@ func (cfg *KafkaConfig) GetKafkaConfigMapConsumerEarliest(clientID, consumerGrou
 }
 
 func (cfg *KafkaConfig) GetKafkaConfigMapProducer(clientID string) *kafka.ConfigMap {
+	result := *cfg.getKafkaConfigMapShared()
+	result["client.id"] = clientID
+	if cfg.EnableIdempotence {
+		result["enable.idempotence"] = true
+	}
+	return &result
+}
+
+// GetKafkaConfigMapTransactionalProducer falls back to TransactionalID when transactionalID is empty,
+// ErrMissingTransactionalID is returned when neither is set.
+// Transactions require idempotence so it is always enabled.
+func (cfg *KafkaConfig) GetKafkaConfigMapTransactionalProducer(clientID, transactionalID string) (*kafka.ConfigMap, error) {
+	if transactionalID == "" {
+		transactionalID = cfg.TransactionalID
+	}
+	if transactionalID == "" {
+		return nil, ErrMissingTransactionalID
+	}
+	result := *cfg.GetKafkaConfigMapProducer(clientID)
+	result["enable.idempotence"] = true
+	result["transactional.id"] = transactionalID
+	return &result, nil
+}
+
+func (cfg *KafkaConfig) GetKafkaConfigMapAdmin(clientID string) *kafka.ConfigMap {
 	result := *cfg.getKafkaConfigMapShared()
 	result["client.id"] = clientID
 	return &result
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestTransactionalProducerConfig(t *testing.T) {
+	tests := []struct {
+		name            string
+		cfg             KafkaConfig
+		transactionalID string
+		want            string
+		err             error
+	}{
+		{
+			name:            "Explicit transactional id",
+			cfg:             KafkaConfig{SslMode: "disable", TransactionalID: "from-env"},
+			transactionalID: "orders-0",
+			want:            "orders-0",
+		},
+		{
+			name: "Transactional id from config",
+			cfg:  KafkaConfig{SslMode: "disable", TransactionalID: "from-env"},
+			want: "from-env",
+		},
+		{
+			name: "Missing transactional id",
+			cfg:  KafkaConfig{SslMode: "disable"},
+			err:  ErrMissingTransactionalID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configMap, err := tt.cfg.GetKafkaConfigMapTransactionalProducer("client", tt.transactionalID)
+			if err != tt.err {
+				t.Fatalf("TestTransactionalProducerConfig(): GetKafkaConfigMapTransactionalProducer error\ngot= \t%v\nwant = \t%v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := (*configMap)["transactional.id"]; got != tt.want {
+				t.Errorf("TestTransactionalProducerConfig(): transactional.id\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+			if got := (*configMap)["enable.idempotence"]; got != true {
+				t.Errorf("TestTransactionalProducerConfig(): enable.idempotence\ngot= \t%v\nwant = \t%v", got, true)
+			}
+		})
+	}
+}
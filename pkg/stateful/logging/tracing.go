@@ -97,6 +97,6 @@ func NewJaegerExporter(ctx context.Context, cfg *config.JaegerTraceConfig) trace
 }
 
 func StartSpan(ctx context.Context, name string) (context.Context, trace.Span) {
-	serviceName := ctx.Value(serviceNameKey{}).(string)
+	serviceName, _ := ctx.Value(serviceNameKey{}).(string)
 	return otel.Tracer(serviceName).Start(ctx, name)
 }
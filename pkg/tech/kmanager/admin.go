@@ -0,0 +1,299 @@
+package kmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/Cobalt0s/creme-brulee/pkg/stateful/config"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	CleanupPolicyDelete        = "delete"
+	CleanupPolicyCompact       = "compact"
+	CleanupPolicyCompactDelete = "compact,delete"
+)
+
+var AdminTimeout = 30 * time.Second
+
+// TopicSpec declares a topic, zero partitions or replication factor mean one.
+// Retention and CleanupPolicy are shorthands for retention.ms and cleanup.policy
+// and take precedence over the same keys in Configs.
+type TopicSpec struct {
+	Name              string
+	Partitions        int
+	ReplicationFactor int
+	// Retention of messages, negative keeps them forever and zero leaves the broker default
+	Retention     time.Duration
+	CleanupPolicy string
+	Configs       map[string]string
+}
+
+func (s TopicSpec) partitions() int {
+	if s.Partitions <= 0 {
+		return 1
+	}
+	return s.Partitions
+}
+
+func (s TopicSpec) replicationFactor() int {
+	if s.ReplicationFactor <= 0 {
+		return 1
+	}
+	return s.ReplicationFactor
+}
+
+func (s TopicSpec) configs() map[string]string {
+	result := map[string]string{}
+	for k, v := range s.Configs {
+		result[k] = v
+	}
+	if s.Retention < 0 {
+		result["retention.ms"] = "-1"
+	} else if s.Retention > 0 {
+		result["retention.ms"] = strconv.FormatInt(s.Retention.Milliseconds(), 10)
+	}
+	if s.CleanupPolicy != "" {
+		result["cleanup.policy"] = s.CleanupPolicy
+	}
+	return result
+}
+
+type DriftKind string
+
+const (
+	DriftMissing     DriftKind = "missing"
+	DriftPartitions  DriftKind = "partitions"
+	DriftReplication DriftKind = "replication"
+	DriftConfig      DriftKind = "config"
+)
+
+// TopicDrift is a difference between a TopicSpec and the topic on the brokers.
+// Drift which can't be reconciled, such as fewer partitions or another replication
+// factor, is reported but never applied.
+type TopicDrift struct {
+	Topic      string
+	Kind       DriftKind
+	Config     string
+	Current    string
+	Desired    string
+	Applicable bool
+}
+
+func (d TopicDrift) String() string {
+	switch d.Kind {
+	case DriftMissing:
+		return fmt.Sprintf("topic %v is missing", d.Topic)
+	case DriftConfig:
+		return fmt.Sprintf("topic %v config %v is %q instead of %q", d.Topic, d.Config, d.Current, d.Desired)
+	default:
+		return fmt.Sprintf("topic %v %v is %v instead of %v", d.Topic, d.Kind, d.Current, d.Desired)
+	}
+}
+
+type TopicAdmin struct {
+	admin KafkaAdmin
+}
+
+func NewTopicAdmin(cfg *config.KafkaConfig, clientID string) (*TopicAdmin, error) {
+	admin, err := kafka.NewAdminClient(cfg.GetKafkaConfigMapAdmin(clientID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to init kafka admin client %v", err)
+	}
+	return NewTopicAdminFromClient(admin), nil
+}
+
+// NewTopicAdminFromClient reconciles topics through an admin client created elsewhere
+func NewTopicAdminFromClient(admin KafkaAdmin) *TopicAdmin {
+	return &TopicAdmin{admin: admin}
+}
+
+func (a *TopicAdmin) Close() {
+	a.admin.Close()
+}
+
+// Reconcile creates missing topics, adds partitions and alters configs until the brokers match specs.
+// The drift found is returned either way, in dry run mode nothing is applied.
+func (a *TopicAdmin) Reconcile(ctx context.Context, specs []TopicSpec, dryRun bool) ([]TopicDrift, error) {
+	log := ctxlogrus.Extract(ctx)
+
+	metadata, err := a.admin.GetMetadata(nil, true, int(AdminTimeout.Milliseconds()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read topic metadata %v", err)
+	}
+	currentConfigs, err := a.describeConfigs(ctx, specs, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []TopicDrift
+	var create []kafka.TopicSpecification
+	var grow []kafka.PartitionsSpecification
+	var alter []kafka.ConfigResource
+	for _, spec := range specs {
+		topic, exists := topicMetadata(metadata, spec.Name)
+		if !exists {
+			drifts = append(drifts, TopicDrift{Topic: spec.Name, Kind: DriftMissing, Applicable: true})
+			create = append(create, kafka.TopicSpecification{
+				Topic:             spec.Name,
+				NumPartitions:     spec.partitions(),
+				ReplicationFactor: spec.replicationFactor(),
+				Config:            spec.configs(),
+			})
+			continue
+		}
+
+		if partitions := len(topic.Partitions); partitions != spec.partitions() {
+			drifts = append(drifts, TopicDrift{
+				Topic:      spec.Name,
+				Kind:       DriftPartitions,
+				Current:    strconv.Itoa(partitions),
+				Desired:    strconv.Itoa(spec.partitions()),
+				Applicable: partitions < spec.partitions(),
+			})
+			if partitions < spec.partitions() {
+				grow = append(grow, kafka.PartitionsSpecification{Topic: spec.Name, IncreaseTo: spec.partitions()})
+			}
+		}
+		if len(topic.Partitions) != 0 {
+			if replicas := len(topic.Partitions[0].Replicas); replicas != spec.replicationFactor() {
+				drifts = append(drifts, TopicDrift{
+					Topic:   spec.Name,
+					Kind:    DriftReplication,
+					Current: strconv.Itoa(replicas),
+					Desired: strconv.Itoa(spec.replicationFactor()),
+				})
+			}
+		}
+
+		configDrifts, resource := configDrift(spec, currentConfigs[spec.Name])
+		drifts = append(drifts, configDrifts...)
+		if resource != nil {
+			alter = append(alter, *resource)
+		}
+	}
+
+	for _, drift := range drifts {
+		log.Infof("topic drift: %v", drift)
+	}
+	if dryRun {
+		return drifts, nil
+	}
+	return drifts, a.apply(ctx, create, grow, alter)
+}
+
+func (a *TopicAdmin) describeConfigs(ctx context.Context, specs []TopicSpec, metadata *kafka.Metadata) (map[string]map[string]kafka.ConfigEntryResult, error) {
+	var resources []kafka.ConfigResource
+	for _, spec := range specs {
+		if _, ok := topicMetadata(metadata, spec.Name); ok {
+			resources = append(resources, kafka.ConfigResource{Type: kafka.ResourceTopic, Name: spec.Name})
+		}
+	}
+	result := map[string]map[string]kafka.ConfigEntryResult{}
+	if len(resources) == 0 {
+		return result, nil
+	}
+
+	described, err := a.admin.DescribeConfigs(ctx, resources, kafka.SetAdminRequestTimeout(AdminTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe topic configs %v", err)
+	}
+	for _, resource := range described {
+		if resource.Error.Code() != kafka.ErrNoError {
+			return nil, fmt.Errorf("failed to describe configs of topic %v %v", resource.Name, resource.Error)
+		}
+		result[resource.Name] = resource.Config
+	}
+	return result, nil
+}
+
+// topicMetadata looks a topic up, brokers may list missing topics with an unknown topic error
+func topicMetadata(metadata *kafka.Metadata, name string) (kafka.TopicMetadata, bool) {
+	topic, ok := metadata.Topics[name]
+	if !ok || topic.Error.Code() == kafka.ErrUnknownTopicOrPart {
+		return kafka.TopicMetadata{}, false
+	}
+	return topic, true
+}
+
+// configDrift compares configs and builds the resource to alter them. Altering replaces
+// every dynamic config of the topic, so the ones set outside the spec are carried over.
+func configDrift(spec TopicSpec, current map[string]kafka.ConfigEntryResult) ([]TopicDrift, *kafka.ConfigResource) {
+	desired := spec.configs()
+	names := make([]string, 0, len(desired))
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var drifts []TopicDrift
+	for _, name := range names {
+		if entry, ok := current[name]; ok && entry.Value == desired[name] {
+			continue
+		}
+		drifts = append(drifts, TopicDrift{
+			Topic:      spec.Name,
+			Kind:       DriftConfig,
+			Config:     name,
+			Current:    current[name].Value,
+			Desired:    desired[name],
+			Applicable: true,
+		})
+	}
+	if len(drifts) == 0 {
+		return nil, nil
+	}
+
+	resource := &kafka.ConfigResource{Type: kafka.ResourceTopic, Name: spec.Name}
+	for name, entry := range current {
+		if _, ok := desired[name]; !ok && entry.Source == kafka.ConfigSourceDynamicTopic {
+			resource.Config = append(resource.Config, kafka.StringMapToConfigEntries(map[string]string{name: entry.Value}, kafka.AlterOperationSet)...)
+		}
+	}
+	resource.Config = append(resource.Config, kafka.StringMapToConfigEntries(desired, kafka.AlterOperationSet)...)
+	return drifts, resource
+}
+
+func (a *TopicAdmin) apply(ctx context.Context, create []kafka.TopicSpecification, grow []kafka.PartitionsSpecification, alter []kafka.ConfigResource) error {
+	timeout := kafka.SetAdminOperationTimeout(AdminTimeout)
+	if len(create) != 0 {
+		results, err := a.admin.CreateTopics(ctx, create, timeout)
+		if err = topicResultsErr("create topics", results, err); err != nil {
+			return err
+		}
+	}
+	if len(grow) != 0 {
+		results, err := a.admin.CreatePartitions(ctx, grow, timeout)
+		if err = topicResultsErr("add partitions", results, err); err != nil {
+			return err
+		}
+	}
+	if len(alter) != 0 {
+		results, err := a.admin.AlterConfigs(ctx, alter, kafka.SetAdminRequestTimeout(AdminTimeout))
+		if err != nil {
+			return fmt.Errorf("failed to alter topic configs %v", err)
+		}
+		for _, result := range results {
+			if result.Error.Code() != kafka.ErrNoError {
+				return fmt.Errorf("failed to alter configs of topic %v %v", result.Name, result.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// topicResultsErr ignores topics which already exist, they were created concurrently
+func topicResultsErr(operation string, results []kafka.TopicResult, err error) error {
+	if err != nil {
+		return fmt.Errorf("failed to %v %v", operation, err)
+	}
+	for _, result := range results {
+		if code := result.Error.Code(); code != kafka.ErrNoError && code != kafka.ErrTopicAlreadyExists {
+			return fmt.Errorf("failed to %v for topic %v %v", operation, result.Topic, result.Error)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAddDefaultTopics(t *testing.T) {
+	got := addDefaultTopics([]string{"orders", "DLQ", "orders"})
+	want := []string{"DLQ", "orders"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("addDefaultTopics()\ngot= \t%v\nwant = \t%v", got, want)
+	}
+}
+
+func TestConfigDrift(t *testing.T) {
+	spec := TopicSpec{
+		Name:          "orders",
+		Retention:     7 * 24 * time.Hour,
+		CleanupPolicy: CleanupPolicyCompact,
+	}
+	entry := func(value string, source kafka.ConfigSource) kafka.ConfigEntryResult {
+		return kafka.ConfigEntryResult{Value: value, Source: source}
+	}
+
+	tests := []struct {
+		name    string
+		current map[string]kafka.ConfigEntryResult
+		drift   []string
+		alter   map[string]string
+	}{
+		{
+			name: "In sync",
+			current: map[string]kafka.ConfigEntryResult{
+				"retention.ms":   entry("604800000", kafka.ConfigSourceDynamicTopic),
+				"cleanup.policy": entry("compact", kafka.ConfigSourceDynamicTopic),
+			},
+		},
+		{
+			name: "Drifted configs keep other dynamic ones",
+			current: map[string]kafka.ConfigEntryResult{
+				"retention.ms":     entry("86400000", kafka.ConfigSourceDynamicTopic),
+				"cleanup.policy":   entry("delete", kafka.ConfigSourceDefault),
+				"segment.bytes":    entry("1024", kafka.ConfigSourceDynamicTopic),
+				"compression.type": entry("producer", kafka.ConfigSourceDefault),
+			},
+			drift: []string{"cleanup.policy", "retention.ms"},
+			alter: map[string]string{
+				"retention.ms":   "604800000",
+				"cleanup.policy": "compact",
+				"segment.bytes":  "1024",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drifts, resource := configDrift(spec, tt.current)
+
+			var drift []string
+			for _, d := range drifts {
+				drift = append(drift, d.Config)
+			}
+			if !reflect.DeepEqual(drift, tt.drift) {
+				t.Errorf("configDrift() drift\ngot= \t%v\nwant = \t%v", drift, tt.drift)
+			}
+
+			var alter map[string]string
+			if resource != nil {
+				alter = map[string]string{}
+				for _, entry := range resource.Config {
+					alter[entry.Name] = entry.Value
+				}
+			}
+			if !reflect.DeepEqual(alter, tt.alter) {
+				t.Errorf("configDrift() alter\ngot= \t%v\nwant = \t%v", alter, tt.alter)
+			}
+		})
+	}
+}
+
+type fakeTopic struct {
+	partitions int
+	replicas   int
+	configs    map[string]string
+}
+
+// fakeAdmin keeps topics in memory and records what TopicAdmin applied
+type fakeAdmin struct {
+	topics map[string]*fakeTopic
+	// unknown topics are listed by metadata with an unknown topic error
+	unknown []string
+	created []string
+	grown   map[string]int
+	altered map[string]map[string]string
+}
+
+func newFakeAdmin(topics map[string]*fakeTopic, unknown ...string) *fakeAdmin {
+	return &fakeAdmin{topics: topics, unknown: unknown, grown: map[string]int{}, altered: map[string]map[string]string{}}
+}
+
+func (a *fakeAdmin) GetMetadata(_ *string, _ bool, _ int) (*kafka.Metadata, error) {
+	metadata := &kafka.Metadata{Topics: map[string]kafka.TopicMetadata{}}
+	for name, topic := range a.topics {
+		partitions := make([]kafka.PartitionMetadata, topic.partitions)
+		for i := range partitions {
+			partitions[i] = kafka.PartitionMetadata{ID: int32(i), Replicas: make([]int32, topic.replicas)}
+		}
+		metadata.Topics[name] = kafka.TopicMetadata{Topic: name, Partitions: partitions}
+	}
+	for _, name := range a.unknown {
+		metadata.Topics[name] = kafka.TopicMetadata{Topic: name, Error: kafka.NewError(kafka.ErrUnknownTopicOrPart, "unknown topic", false)}
+	}
+	return metadata, nil
+}
+
+func (a *fakeAdmin) DescribeConfigs(_ context.Context, resources []kafka.ConfigResource, _ ...kafka.DescribeConfigsAdminOption) ([]kafka.ConfigResourceResult, error) {
+	results := make([]kafka.ConfigResourceResult, len(resources))
+	for i, resource := range resources {
+		results[i] = kafka.ConfigResourceResult{Type: resource.Type, Name: resource.Name}
+		topic, ok := a.topics[resource.Name]
+		if !ok {
+			results[i].Error = kafka.NewError(kafka.ErrUnknownTopicOrPart, "unknown topic", false)
+			continue
+		}
+		results[i].Config = map[string]kafka.ConfigEntryResult{}
+		for name, value := range topic.configs {
+			results[i].Config[name] = kafka.ConfigEntryResult{Name: name, Value: value, Source: kafka.ConfigSourceDynamicTopic}
+		}
+	}
+	return results, nil
+}
+
+func (a *fakeAdmin) CreateTopics(_ context.Context, topics []kafka.TopicSpecification, _ ...kafka.CreateTopicsAdminOption) ([]kafka.TopicResult, error) {
+	results := make([]kafka.TopicResult, len(topics))
+	for i, spec := range topics {
+		a.created = append(a.created, spec.Topic)
+		a.topics[spec.Topic] = &fakeTopic{partitions: spec.NumPartitions, replicas: spec.ReplicationFactor, configs: spec.Config}
+		results[i] = kafka.TopicResult{Topic: spec.Topic}
+	}
+	return results, nil
+}
+
+func (a *fakeAdmin) CreatePartitions(_ context.Context, partitions []kafka.PartitionsSpecification, _ ...kafka.CreatePartitionsAdminOption) ([]kafka.TopicResult, error) {
+	results := make([]kafka.TopicResult, len(partitions))
+	for i, spec := range partitions {
+		a.grown[spec.Topic] = spec.IncreaseTo
+		results[i] = kafka.TopicResult{Topic: spec.Topic}
+	}
+	return results, nil
+}
+
+func (a *fakeAdmin) AlterConfigs(_ context.Context, resources []kafka.ConfigResource, _ ...kafka.AlterConfigsAdminOption) ([]kafka.ConfigResourceResult, error) {
+	results := make([]kafka.ConfigResourceResult, len(resources))
+	for i, resource := range resources {
+		a.altered[resource.Name] = map[string]string{}
+		for _, entry := range resource.Config {
+			a.altered[resource.Name][entry.Name] = entry.Value
+		}
+		results[i] = kafka.ConfigResourceResult{Type: resource.Type, Name: resource.Name}
+	}
+	return results, nil
+}
+
+func (a *fakeAdmin) Close() {}
+
+func TestTopicAdminReconcile(t *testing.T) {
+	spec := TopicSpec{Name: "orders", Partitions: 3, ReplicationFactor: 3, Retention: time.Hour}
+	drifted := func() map[string]*fakeTopic {
+		return map[string]*fakeTopic{"orders": {partitions: 1, replicas: 1, configs: map[string]string{"retention.ms": "1000"}}}
+	}
+	driftReport := []string{
+		"topic orders partitions is 1 instead of 3",
+		"topic orders replication is 1 instead of 3",
+		`topic orders config retention.ms is "1000" instead of "3600000"`,
+	}
+
+	tests := []struct {
+		name    string
+		admin   *fakeAdmin
+		dryRun  bool
+		drift   []string
+		created []string
+		grown   map[string]int
+		altered map[string]map[string]string
+	}{
+		{
+			name:    "Missing topic is created",
+			admin:   newFakeAdmin(map[string]*fakeTopic{}),
+			drift:   []string{"topic orders is missing"},
+			created: []string{"orders"},
+			grown:   map[string]int{},
+			altered: map[string]map[string]string{},
+		},
+		{
+			name:    "Topic listed as unknown is created",
+			admin:   newFakeAdmin(map[string]*fakeTopic{}, "orders"),
+			drift:   []string{"topic orders is missing"},
+			created: []string{"orders"},
+			grown:   map[string]int{},
+			altered: map[string]map[string]string{},
+		},
+		{
+			name:    "Drift is reconciled",
+			admin:   newFakeAdmin(drifted()),
+			drift:   driftReport,
+			grown:   map[string]int{"orders": 3},
+			altered: map[string]map[string]string{"orders": {"retention.ms": "3600000"}},
+		},
+		{
+			name:    "Dry run only reports drift",
+			admin:   newFakeAdmin(drifted()),
+			dryRun:  true,
+			drift:   driftReport,
+			grown:   map[string]int{},
+			altered: map[string]map[string]string{},
+		},
+		{
+			name: "Topic in sync",
+			admin: newFakeAdmin(map[string]*fakeTopic{
+				"orders": {partitions: 3, replicas: 3, configs: map[string]string{"retention.ms": "3600000"}},
+			}),
+			grown:   map[string]int{},
+			altered: map[string]map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			drifts, err := NewTopicAdminFromClient(tt.admin).Reconcile(context.Background(), []TopicSpec{spec}, tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var drift []string
+			for _, d := range drifts {
+				drift = append(drift, d.String())
+			}
+			if !reflect.DeepEqual(drift, tt.drift) {
+				t.Errorf("TestTopicAdminReconcile(): drift\ngot= \t%v\nwant = \t%v", drift, tt.drift)
+			}
+			if !reflect.DeepEqual(tt.admin.created, tt.created) {
+				t.Errorf("TestTopicAdminReconcile(): created\ngot= \t%v\nwant = \t%v", tt.admin.created, tt.created)
+			}
+			if !reflect.DeepEqual(tt.admin.grown, tt.grown) {
+				t.Errorf("TestTopicAdminReconcile(): grown\ngot= \t%v\nwant = \t%v", tt.admin.grown, tt.grown)
+			}
+			if !reflect.DeepEqual(tt.admin.altered, tt.altered) {
+				t.Errorf("TestTopicAdminReconcile(): altered\ngot= \t%v\nwant = \t%v", tt.admin.altered, tt.altered)
+			}
+		})
+	}
+}
+
+func TestWithDefaultSpecs(t *testing.T) {
+	tier := RetryTier{Delay: time.Minute}
+	specs := []TopicSpec{
+		{Name: "orders", Partitions: 6, ReplicationFactor: 3},
+		{Name: DeadLetterQueueTopic, Partitions: 2},
+	}
+
+	got := withDefaultSpecs(specs, []RetryTier{tier})
+	want := []TopicSpec{
+		{Name: "orders", Partitions: 6, ReplicationFactor: 3},
+		{Name: DeadLetterQueueTopic, Partitions: 2},
+		{Name: tier.TopicFor("orders"), Partitions: 6, ReplicationFactor: 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TestWithDefaultSpecs(): withDefaultSpecs\ngot= \t%v\nwant = \t%v", got, want)
+	}
+}
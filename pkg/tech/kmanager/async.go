@@ -0,0 +1,200 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"time"
+)
+
+var (
+	// ProducerCloseTimeout bounds how long Close waits for queued messages to be delivered
+	ProducerCloseTimeout = 30 * time.Second
+
+	ErrProducerClosed = errors.New("producer is closed")
+
+	deliveryQueueSize = 1024
+)
+
+// Delivery is the outcome of a message produced asynchronously
+type Delivery struct {
+	done      chan struct{}
+	partition kafka.TopicPartition
+	err       error
+
+	topic string
+	span  trace.Span
+}
+
+func newDelivery(topic string, span trace.Span) *Delivery {
+	return &Delivery{done: make(chan struct{}), topic: topic, span: span}
+}
+
+// Done is closed once the message is acknowledged or failed
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait blocks until the message is delivered, returning the partition and offset it was written to
+func (d *Delivery) Wait(ctx context.Context) (kafka.TopicPartition, error) {
+	select {
+	case <-d.done:
+		return d.partition, d.err
+	case <-ctx.Done():
+		return kafka.TopicPartition{}, ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(partition kafka.TopicPartition, err error) {
+	d.partition = partition
+	d.err = err
+	if err != nil {
+		d.span.SetStatus(codes.Error, "failed sending message")
+	}
+	d.span.End()
+	close(d.done)
+}
+
+// ProduceAsync enqueues message without waiting for it to be acknowledged
+func (p *MessageProducer) ProduceAsync(ctx context.Context, message Message) *Delivery {
+	ctx, span := traceFromHeadersNamed(ctx, message.Headers(), message.Value(), "Harvested")
+	delivery := newDelivery(*message.Topic(), span)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		delivery.resolve(kafka.TopicPartition{}, ErrProducerClosed)
+		return delivery
+	}
+	p.startDeliveries()
+
+	msg, err := p.toKafkaMessage(ctx, message)
+	if err != nil {
+		p.metrics.deliveryFailed(delivery.topic)
+		delivery.resolve(kafka.TopicPartition{}, err)
+		return delivery
+	}
+	msg.Opaque = delivery
+	if err = p.producer.Produce(msg, p.deliveries); err != nil {
+		log := ctxlogrus.Extract(ctx)
+		log.Error("failed to enqueue message for kafka producer")
+		p.metrics.deliveryFailed(delivery.topic)
+		delivery.resolve(kafka.TopicPartition{}, err)
+		return delivery
+	}
+	p.pending[delivery] = true
+	return delivery
+}
+
+// ProduceMessages enqueues all messages before waiting for them, a *BatchError
+// keyed by the index of each failed message is returned when only some failed
+func (p *MessageProducer) ProduceMessages(ctx context.Context, messages []Message) error {
+	deliveries := make([]*Delivery, len(messages))
+	for i, message := range messages {
+		deliveries[i] = p.ProduceAsync(ctx, message)
+	}
+
+	failed := NewBatchError()
+	for i, delivery := range deliveries {
+		if _, err := delivery.Wait(ctx); err != nil {
+			failed.Fail(i, err)
+		}
+	}
+	if len(failed.Failures) == 0 {
+		return nil
+	}
+	return failed
+}
+
+// Flush waits until every message enqueued so far is delivered or ctx is done,
+// the Delivery of each asynchronous message is resolved by then
+func (p *MessageProducer) Flush(ctx context.Context) error {
+	p.mu.Lock()
+	outstanding := make([]*Delivery, 0, len(p.pending))
+	for delivery := range p.pending {
+		outstanding = append(outstanding, delivery)
+	}
+	p.mu.Unlock()
+
+	for p.producer.Flush(100) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	// reports handed over by the client may not be routed to their Delivery yet
+	for _, delivery := range outstanding {
+		select {
+		case <-delivery.Done():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close flushes queued messages for up to ProducerCloseTimeout and releases the producer,
+// messages which weren't delivered by then fail with ErrProducerClosed
+func (p *MessageProducer) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ProducerCloseTimeout)
+	defer cancel()
+	_ = p.Flush(ctx)
+	p.producer.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.deliveries != nil {
+		close(p.deliveries)
+	}
+	for delivery := range p.pending {
+		delivery.resolve(kafka.TopicPartition{}, ErrProducerClosed)
+	}
+	p.pending = nil
+}
+
+// startDeliveries routes delivery reports to the Delivery of their message, p.mu must be held
+func (p *MessageProducer) startDeliveries() {
+	if p.deliveries != nil {
+		return
+	}
+	p.deliveries = make(chan kafka.Event, deliveryQueueSize)
+	p.pending = map[*Delivery]bool{}
+	go func(deliveries chan kafka.Event) {
+		for event := range deliveries {
+			msg, ok := event.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			delivery, ok := msg.Opaque.(*Delivery)
+			if !ok {
+				continue
+			}
+			if msg.TopicPartition.Error != nil {
+				p.metrics.deliveryFailed(delivery.topic)
+			}
+
+			p.mu.Lock()
+			_, pending := p.pending[delivery]
+			delete(p.pending, delivery)
+			p.mu.Unlock()
+			if pending {
+				delivery.resolve(msg.TopicPartition, msg.TopicPartition.Error)
+			}
+		}
+	}(p.deliveries)
+}
+
+// OrderedDelivery tells whether messages of a partition keep their order when retried, see WithOrderedDelivery
+func (p *MessageProducer) OrderedDelivery() bool {
+	return p.orderedDelivery
+}
@@ -0,0 +1,113 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeliveryWait(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	client := broker.NewProducer()
+	producer := NewMessageProducerFromClient(client)
+	defer producer.Close()
+
+	for i := 0; i < 2; i++ {
+		partition, err := producer.ProduceAsync(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}).Wait(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if partition.Offset != kafka.Offset(i) || *partition.Topic != "orders" {
+			t.Errorf("TestDeliveryWait(): Wait\ngot= \t%v\nwant = \t%v", partition, kafka.Offset(i))
+		}
+	}
+
+	client.Hold()
+	defer client.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := producer.ProduceAsync(ctx, &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}).Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("TestDeliveryWait(): Wait of a held message\ngot= \t%v\nwant = \t%v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestProduceMessages(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	broker.FailProduce("invoices", kafka.NewError(kafka.ErrMsgSizeTooLarge, "too large", false))
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	defer producer.Close()
+
+	err := producer.ProduceMessages(context.Background(), []Message{
+		&OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"},
+		&OutboxORM{KafkaTopic: "invoices", KafkaKey: "42", KafkaValue: "issued"},
+		&OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "paid"},
+	})
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("TestProduceMessages(): ProduceMessages\ngot= \t%v\nwant = \t%v", err, "a *BatchError")
+	}
+	failed := []int{}
+	for i := range batchErr.Failures {
+		failed = append(failed, i)
+	}
+	if !reflect.DeepEqual(failed, []int{1}) {
+		t.Errorf("TestProduceMessages(): failures\ngot= \t%v\nwant = \t%v", failed, []int{1})
+	}
+	if delivered := len(broker.Messages("orders")); delivered != 2 {
+		t.Errorf("TestProduceMessages(): delivered\ngot= \t%v\nwant = \t%v", delivered, 2)
+	}
+}
+
+func TestProducerFlush(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	defer producer.Close()
+
+	deliveries := make([]*Delivery, 100)
+	for i := range deliveries {
+		deliveries[i] = producer.ProduceAsync(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"})
+	}
+	if err := producer.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved := 0
+	for _, delivery := range deliveries {
+		select {
+		case <-delivery.Done():
+			resolved++
+		default:
+		}
+	}
+	if resolved != len(deliveries) {
+		t.Errorf("TestProducerFlush(): resolved deliveries\ngot= \t%v\nwant = \t%v", resolved, len(deliveries))
+	}
+}
+
+func TestProducerClose(t *testing.T) {
+	ProducerCloseTimeout = 20 * time.Millisecond
+	defer func() {
+		ProducerCloseTimeout = 30 * time.Second
+	}()
+
+	broker := kafkatest.NewBroker()
+	client := broker.NewProducer()
+	producer := NewMessageProducerFromClient(client)
+
+	client.Hold()
+	pending := producer.ProduceAsync(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"})
+	producer.Close()
+	client.Release()
+
+	if _, err := pending.Wait(context.Background()); err != ErrProducerClosed {
+		t.Errorf("TestProducerClose(): Wait of a pending message\ngot= \t%v\nwant = \t%v", err, ErrProducerClosed)
+	}
+	closed := producer.ProduceAsync(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"})
+	if _, err := closed.Wait(context.Background()); err != ErrProducerClosed {
+		t.Errorf("TestProducerClose(): Wait after Close\ngot= \t%v\nwant = \t%v", err, ErrProducerClosed)
+	}
+}
@@ -0,0 +1,223 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/stateful/logging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"go.opentelemetry.io/otel/codes"
+	"gorm.io/gorm"
+	"time"
+)
+
+// BatchTopicHandler handles several messages at once. Returning a *BatchError marks only
+// the listed messages as failed, any other error fails the whole batch.
+// Failed messages are retried one by one and end up in retry topics or the DLQ.
+type BatchTopicHandler func(ctx context.Context, arguments *messaging.ContextualArguments,
+	db *gorm.DB, msgs []*kafka.Message) error
+
+// BatchError is also returned by ProduceMessages for the messages it failed to deliver
+type BatchError struct {
+	// Failures are keyed by the index of the message in the batch
+	Failures map[int]error
+}
+
+func NewBatchError() *BatchError {
+	return &BatchError{Failures: map[int]error{}}
+}
+
+func (e *BatchError) Fail(index int, err error) *BatchError {
+	e.Failures[index] = err
+	return e
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%v messages of the batch failed", len(e.Failures))
+}
+
+var (
+	ErrBatchOption = errors.New("consumer option doesn't apply to batches")
+)
+
+// StartBatch consumes messages in batches of up to maxSize, waiting at most maxWait
+// for a batch to fill up. Offsets of a batch are committed together.
+// Batches go through the batch middlewares, WithMiddlewares, WithIdempotency and
+// WithConcurrency are rejected with ErrBatchOption.
+func (mc *MessageConsumer) StartBatch(ctx context.Context, handleBatch BatchTopicHandler, maxSize int, maxWait time.Duration) error {
+	if err := mc.checkBatchOptions(); err != nil {
+		return err
+	}
+	handleBatch = ChainBatch(handleBatch, mc.batchMiddlewares...)
+	b := &batcher{
+		mc:          mc,
+		handleBatch: handleBatch,
+		maxSize:     maxSize,
+		maxWait:     maxWait,
+	}
+	// single messages are handled through the batch handler when retried
+	return mc.run(ctx, func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		return handleBatch(ctx, arguments, db, []*kafka.Message{msg})
+	}, b)
+}
+
+func (mc *MessageConsumer) checkBatchOptions() error {
+	switch {
+	case len(mc.middlewares) != 0:
+		return fmt.Errorf("%w: WithMiddlewares, use WithBatchMiddlewares", ErrBatchOption)
+	case mc.idempotent:
+		return fmt.Errorf("%w: WithIdempotency", ErrBatchOption)
+	case mc.workers > 1:
+		return fmt.Errorf("%w: WithConcurrency", ErrBatchOption)
+	}
+	return nil
+}
+
+type batcher struct {
+	mc          *MessageConsumer
+	handleBatch BatchTopicHandler
+	maxSize     int
+	maxWait     time.Duration
+
+	pending  []workerTask
+	deadline time.Time
+	// retry handles failed messages alone through the batch handler
+	retry TopicHandler
+}
+
+func (b *batcher) add(ctx context.Context, msg *kafka.Message) error {
+	state, err := b.mc.retryStateOf(msg)
+	if err == errRetryNotDue {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(b.pending) == 0 {
+		b.deadline = time.Now().Add(b.maxWait)
+	}
+	b.pending = append(b.pending, workerTask{msg: msg, state: state})
+	if len(b.pending) >= b.maxSize {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+// drop forgets pending messages of partitions which are no longer ours, like lost ones
+func (b *batcher) drop(partitions []kafka.TopicPartition) {
+	b.pending, _ = splitTasks(b.pending, partitions)
+}
+
+// drain handles and commits the pending messages of partitions right away, those of
+// other partitions stay pending. A nil partitions drains every pending message.
+func (b *batcher) drain(ctx context.Context, partitions []kafka.TopicPartition) error {
+	kept, drained := b.pending, b.pending
+	if partitions != nil {
+		kept, drained = splitTasks(b.pending, partitions)
+	} else {
+		kept = nil
+	}
+	if len(drained) == 0 {
+		return nil
+	}
+	b.pending = drained
+	err := b.flush(ctx)
+	b.pending = kept
+	return err
+}
+
+// splitTasks separates tasks of partitions from the other ones
+func splitTasks(tasks []workerTask, partitions []kafka.TopicPartition) (others, matching []workerTask) {
+	selected := map[string]bool{}
+	for _, tp := range partitions {
+		selected[partitionKey(tp)] = true
+	}
+	for _, task := range tasks {
+		if selected[partitionKey(task.msg.TopicPartition)] {
+			matching = append(matching, task)
+		} else {
+			others = append(others, task)
+		}
+	}
+	return others, matching
+}
+
+func (b *batcher) flushIfDue(ctx context.Context) error {
+	if len(b.pending) == 0 || time.Now().Before(b.deadline) {
+		return nil
+	}
+	return b.flush(ctx)
+}
+
+// readTimeout shortens polling so a partial batch is not held past its deadline
+func (b *batcher) readTimeout(timeout time.Duration) time.Duration {
+	if len(b.pending) == 0 {
+		return timeout
+	}
+	if remaining := time.Until(b.deadline); remaining < timeout {
+		if remaining < time.Millisecond {
+			return time.Millisecond
+		}
+		return remaining
+	}
+	return timeout
+}
+
+func (b *batcher) flush(ctx context.Context) error {
+	log := ctxlogrus.Extract(ctx)
+	tasks := b.pending
+	b.pending = nil
+
+	msgs := make([]*kafka.Message, len(tasks))
+	for i, task := range tasks {
+		msgs[i] = task.state.restore(task.msg)
+	}
+
+	batchCtx, span := logging.StartSpan(ctx, "EventsConsumed")
+	defer span.End()
+
+	failures := map[int]error{}
+	if err := b.handleBatch(batchCtx, b.mc.arguments, b.mc.db, msgs); err != nil {
+		span.SetStatus(codes.Error, "failed processing batch")
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			failures = batchErr.Failures
+		} else {
+			for i := range msgs {
+				failures[i] = err
+			}
+		}
+	}
+
+	// keep the order of failed messages sharing a key
+	for i, task := range tasks {
+		failure, ok := failures[i]
+		if !ok {
+			continue
+		}
+		log.Errorf("failed processing event in batch, retrying it alone: %v", failure)
+		if err := b.mc.handle(ctx, task.msg, task.state, b.retry, b.mc.stop); err != nil {
+			return err
+		}
+	}
+
+	offsets := map[string]kafka.TopicPartition{}
+	for _, task := range tasks {
+		tp := task.msg.TopicPartition
+		tp.Offset++
+		if committed, ok := offsets[partitionKey(tp)]; !ok || committed.Offset < tp.Offset {
+			offsets[partitionKey(tp)] = tp
+		}
+	}
+	commit := make([]kafka.TopicPartition, 0, len(offsets))
+	for _, tp := range offsets {
+		commit = append(commit, tp)
+	}
+	if _, err := b.mc.consumer.CommitOffsets(commit); err != nil {
+		log.Warnf("couldn't commit batch offsets %v", err)
+	}
+	return nil
+}
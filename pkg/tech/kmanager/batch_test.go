@@ -0,0 +1,241 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartBatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []ConsumerOption
+		messages    int
+		maxSize     int
+		maxWait     time.Duration
+		handler     BatchTopicHandler
+		batches     []int
+		deadLetters int
+	}{
+		{
+			name:     "Flushed when full",
+			messages: 4,
+			maxSize:  2,
+			maxWait:  time.Minute,
+			batches:  []int{2, 2},
+		},
+		{
+			name:     "Flushed when the wait is over",
+			messages: 3,
+			maxSize:  10,
+			maxWait:  20 * time.Millisecond,
+			batches:  []int{3},
+		},
+		{
+			name:     "Failed messages of a batch are retried alone",
+			messages: 3,
+			maxSize:  3,
+			maxWait:  time.Minute,
+			handler: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+				batchErr := NewBatchError()
+				for i, msg := range msgs {
+					if string(msg.Value) == "1" {
+						batchErr.Fail(i, errors.New("invalid order"))
+					}
+				}
+				if len(batchErr.Failures) != 0 {
+					return batchErr
+				}
+				return nil
+			},
+			batches:     []int{3, 1},
+			deadLetters: 1,
+		},
+		{
+			name:     "Failed batch is retried message by message",
+			messages: 2,
+			maxSize:  2,
+			maxWait:  time.Minute,
+			handler: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+				if len(msgs) > 1 {
+					return errors.New("database is down")
+				}
+				return nil
+			},
+			batches: []int{2, 1, 1},
+		},
+		{
+			name:     "Panicking batch is recovered",
+			opts:     []ConsumerOption{WithBatchMiddlewares(BatchRecoveryMiddleware(), BatchTimingMiddleware())},
+			messages: 2,
+			maxSize:  2,
+			maxWait:  time.Minute,
+			handler: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+				if len(msgs) > 1 {
+					panic("nil map")
+				}
+				return nil
+			},
+			batches: []int{2, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer())
+			for i := 0; i < tt.messages; i++ {
+				if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: strconv.Itoa(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var mu sync.Mutex
+			var batches []int
+			handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+				mu.Lock()
+				batches = append(batches, len(msgs))
+				mu.Unlock()
+				if tt.handler == nil {
+					return nil
+				}
+				return tt.handler(ctx, arguments, db, msgs)
+			}
+			opts := append([]ConsumerOption{WithRetryPolicy(NoRetries())}, tt.opts...)
+			mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"}, opts...)
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- mc.StartBatch(context.Background(), handler, tt.maxSize, tt.maxWait)
+			}()
+			waitFor(t, func() bool {
+				return broker.Committed("billing", "orders", 0) == kafka.Offset(tt.messages)
+			})
+			if err := mc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(batches, tt.batches) {
+				t.Errorf("TestStartBatch(): batch sizes\ngot= \t%v\nwant = \t%v", batches, tt.batches)
+			}
+			if deadLetters := len(broker.Messages(DeadLetterQueueTopic)); deadLetters != tt.deadLetters {
+				t.Errorf("TestStartBatch(): dead letters\ngot= \t%v\nwant = \t%v", deadLetters, tt.deadLetters)
+			}
+		})
+	}
+}
+
+func TestStartBatchOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  ConsumerOption
+	}{
+		{name: "Message middlewares", opt: WithMiddlewares(RecoveryMiddleware())},
+		{name: "Idempotency", opt: WithIdempotency()},
+		{name: "Concurrency", opt: WithConcurrency(4)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer())
+			mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"}, tt.opt)
+
+			err := mc.StartBatch(context.Background(), func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+				return nil
+			}, 10, time.Second)
+			if !errors.Is(err, ErrBatchOption) {
+				t.Errorf("TestStartBatchOptions(): StartBatch\ngot= \t%v\nwant = \t%v", err, ErrBatchOption)
+			}
+		})
+	}
+}
+
+func TestBatchDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		drain     func(ctx context.Context, mc *MessageConsumer, b *batcher, partitions []kafka.TopicPartition)
+		handled   []string
+		pending   int
+		committed []kafka.Offset
+	}{
+		{
+			name: "Revoked partitions are flushed",
+			drain: func(ctx context.Context, mc *MessageConsumer, b *batcher, partitions []kafka.TopicPartition) {
+				mc.revoke(ctx, partitions[:1], true)
+			},
+			handled:   []string{"0", "1"},
+			pending:   1,
+			committed: []kafka.Offset{2, kafka.OffsetInvalid},
+		},
+		{
+			name: "Lost partitions are dropped",
+			drain: func(ctx context.Context, mc *MessageConsumer, b *batcher, partitions []kafka.TopicPartition) {
+				mc.revoke(ctx, partitions[:1], false)
+			},
+			pending:   1,
+			committed: []kafka.Offset{kafka.OffsetInvalid, kafka.OffsetInvalid},
+		},
+		{
+			name: "Stopping flushes every partition",
+			drain: func(ctx context.Context, mc *MessageConsumer, b *batcher, partitions []kafka.TopicPartition) {
+				if err := mc.drainBatch(ctx, b); err != nil {
+					t.Fatal(err)
+				}
+			},
+			handled:   []string{"0", "1", "2"},
+			committed: []kafka.Offset{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), nil, "billing", []string{"orders"})
+			var handled []string
+			b := &batcher{
+				mc: mc,
+				handleBatch: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+					for _, msg := range msgs {
+						handled = append(handled, string(msg.Value))
+					}
+					return nil
+				},
+				maxSize: 10,
+				maxWait: time.Minute,
+			}
+			mc.batch = b
+
+			topic := "orders"
+			partitions := []kafka.TopicPartition{{Topic: &topic, Partition: 0}, {Topic: &topic, Partition: 1}}
+			for i, tp := range []kafka.TopicPartition{
+				{Topic: &topic, Partition: 0, Offset: 0},
+				{Topic: &topic, Partition: 0, Offset: 1},
+				{Topic: &topic, Partition: 1, Offset: 0},
+			} {
+				b.pending = append(b.pending, workerTask{msg: &kafka.Message{TopicPartition: tp, Value: []byte(strconv.Itoa(i))}, state: &retryState{}})
+			}
+
+			tt.drain(context.Background(), mc, b, partitions)
+
+			if !reflect.DeepEqual(handled, tt.handled) {
+				t.Errorf("TestBatchDrain(): handled\ngot= \t%v\nwant = \t%v", handled, tt.handled)
+			}
+			if len(b.pending) != tt.pending {
+				t.Errorf("TestBatchDrain(): pending\ngot= \t%v\nwant = \t%v", len(b.pending), tt.pending)
+			}
+			committed := []kafka.Offset{broker.Committed("billing", topic, 0), broker.Committed("billing", topic, 1)}
+			if !reflect.DeepEqual(committed, tt.committed) {
+				t.Errorf("TestBatchDrain(): committed\ngot= \t%v\nwant = \t%v", committed, tt.committed)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"time"
+)
+
+// KafkaConsumer is the part of *kafka.Consumer used by MessageConsumer and the DLQ readers,
+// kafkatest.Consumer implements it without a broker
+type KafkaConsumer interface {
+	SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error
+	ReadMessage(timeout time.Duration) (*kafka.Message, error)
+	CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error)
+	CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Committed(partitions []kafka.TopicPartition, timeoutMs int) ([]kafka.TopicPartition, error)
+	Assignment() ([]kafka.TopicPartition, error)
+	AssignmentLost() bool
+	Pause(partitions []kafka.TopicPartition) error
+	Resume(partitions []kafka.TopicPartition) error
+	Seek(partition kafka.TopicPartition, timeoutMs int) error
+	Assign(partitions []kafka.TopicPartition) error
+	GetWatermarkOffsets(topic string, partition int32) (low, high int64, err error)
+	QueryWatermarkOffsets(topic string, partition int32, timeoutMs int) (low, high int64, err error)
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	GetConsumerGroupMetadata() (*kafka.ConsumerGroupMetadata, error)
+	Close() error
+}
+
+// KafkaProducer is the part of *kafka.Producer used by MessageProducer,
+// kafkatest.Producer implements it without a broker
+type KafkaProducer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+	Flush(timeoutMs int) int
+	Close()
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	GetFatalError() error
+	InitTransactions(ctx context.Context) error
+	BeginTransaction() error
+	SendOffsetsToTransaction(ctx context.Context, offsets []kafka.TopicPartition, consumerMetadata *kafka.ConsumerGroupMetadata) error
+	CommitTransaction(ctx context.Context) error
+	AbortTransaction(ctx context.Context) error
+}
+
+// KafkaAdmin is the part of *kafka.AdminClient used by TopicAdmin
+type KafkaAdmin interface {
+	GetMetadata(topic *string, allTopics bool, timeoutMs int) (*kafka.Metadata, error)
+	DescribeConfigs(ctx context.Context, resources []kafka.ConfigResource, options ...kafka.DescribeConfigsAdminOption) ([]kafka.ConfigResourceResult, error)
+	CreateTopics(ctx context.Context, topics []kafka.TopicSpecification, options ...kafka.CreateTopicsAdminOption) ([]kafka.TopicResult, error)
+	CreatePartitions(ctx context.Context, partitions []kafka.PartitionsSpecification, options ...kafka.CreatePartitionsAdminOption) ([]kafka.TopicResult, error)
+	AlterConfigs(ctx context.Context, resources []kafka.ConfigResource, options ...kafka.AlterConfigsAdminOption) ([]kafka.ConfigResourceResult, error)
+	Close()
+}
+
+var (
+	_ KafkaConsumer = (*kafka.Consumer)(nil)
+	_ KafkaProducer = (*kafka.Producer)(nil)
+	_ KafkaAdmin    = (*kafka.AdminClient)(nil)
+)
@@ -0,0 +1,200 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CloudEventsMode int
+
+const (
+	CloudEventsDisabled CloudEventsMode = iota
+	// CloudEventsStructured sends the whole envelope as the message value
+	CloudEventsStructured
+	// CloudEventsBinary sends attributes as ce_ headers and the event as the message value
+	CloudEventsBinary
+)
+
+const (
+	HeaderContentType = "content-type"
+	// HeaderEventTime is when the event was sent to the outbox, in RFC 3339
+	HeaderEventTime         = "event-time"
+	cloudEventsHeaderPrefix = "ce_"
+)
+
+var (
+	ErrNotCloudEvent = errors.New("message is not a cloud event")
+)
+
+// WithCloudEvents sends the plain JSON events of the outbox as CloudEvents in mode,
+// source identifies the producing service and the topic is used when it's empty.
+// Compressed and binary encoded events are sent as they are.
+func WithCloudEvents(mode CloudEventsMode, source string) ProducerOption {
+	return func(p *MessageProducer) {
+		p.cloudEvents = mode
+		p.cloudEventsSource = source
+	}
+}
+
+// wrapCloudEvent returns the value and headers of a JSON event in the CloudEvents mode
+// of the producer, the key becomes the subject
+func (p *MessageProducer) wrapCloudEvent(message Message) ([]byte, []kafka.Header, error) {
+	source := p.cloudEventsSource
+	if source == "" {
+		source = *message.Topic()
+	}
+	cloudEvent, err := messaging.NewCloudEvent(source, string(message.Key()), message.Value())
+	if err != nil {
+		return nil, nil, err
+	}
+	stampCloudEvent(cloudEvent, message)
+
+	headers := make([]kafka.Header, len(message.Headers()))
+	copy(headers, message.Headers())
+	carrier := NewHeadersCarrier(&headers)
+	if p.cloudEvents == CloudEventsBinary {
+		for k, v := range cloudEventHeaders(cloudEvent) {
+			carrier.Set(k, v)
+		}
+		return message.Value(), headers, nil
+	}
+	structured, err := cloudEvent.MarshalJSON()
+	if err != nil {
+		return nil, nil, err
+	}
+	carrier.Set(HeaderContentType, messaging.CloudEventsContentType)
+	return structured, headers, nil
+}
+
+// stampCloudEvent keeps the id and time the event was sent with, so every publish of
+// an outbox row is the same CloudEvent. Rows sent without them are identified by their ID.
+func stampCloudEvent(cloudEvent *messaging.CloudEvent, message Message) {
+	msg := &kafka.Message{Headers: message.Headers()}
+	if id, ok := HeaderValue(msg, HeaderMessageID); ok && id != "" {
+		cloudEvent.ID = id
+	} else if outboxORM, ok := message.(*OutboxORM); ok && outboxORM.ID != 0 {
+		cloudEvent.ID = strconv.FormatUint(uint64(outboxORM.ID), 10)
+	}
+	if sentAt, ok := HeaderValue(msg, HeaderEventTime); ok {
+		if parsed, err := time.Parse(time.RFC3339Nano, sentAt); err == nil {
+			parsed = parsed.UTC()
+			cloudEvent.Time = &parsed
+		}
+	}
+}
+
+// isCloudEvent tells whether headers are those of a CloudEvent in either mode
+func isCloudEvent(headers []kafka.Header) bool {
+	msg := &kafka.Message{Headers: headers}
+	if _, ok := HeaderValue(msg, cloudEventsHeaderPrefix+"specversion"); ok {
+		return true
+	}
+	contentType, _ := HeaderValue(msg, HeaderContentType)
+	return contentType == messaging.CloudEventsContentType
+}
+
+func cloudEventHeaders(cloudEvent *messaging.CloudEvent) HeaderMap {
+	headers := HeaderMap{
+		HeaderContentType:                       cloudEvent.DataContentType,
+		cloudEventsHeaderPrefix + "specversion": cloudEvent.SpecVersion,
+		cloudEventsHeaderPrefix + "id":          cloudEvent.ID,
+		cloudEventsHeaderPrefix + "source":      cloudEvent.Source,
+		cloudEventsHeaderPrefix + "type":        cloudEvent.Type,
+	}
+	if cloudEvent.Subject != "" {
+		headers[cloudEventsHeaderPrefix+"subject"] = cloudEvent.Subject
+	}
+	if cloudEvent.Time != nil {
+		headers[cloudEventsHeaderPrefix+"time"] = cloudEvent.Time.Format(time.RFC3339Nano)
+	}
+	for name, value := range cloudEvent.Extensions {
+		headers[cloudEventsHeaderPrefix+name] = value
+	}
+	return headers
+}
+
+// CloudEventFromMessage reads a CloudEvent sent in either mode, ErrNotCloudEvent is returned otherwise
+func CloudEventFromMessage(msg *kafka.Message) (*messaging.CloudEvent, error) {
+	if _, ok := HeaderValue(msg, cloudEventsHeaderPrefix+"specversion"); !ok {
+		if !messaging.IsStructuredCloudEvent(msg.Value) {
+			return nil, ErrNotCloudEvent
+		}
+		cloudEvent := &messaging.CloudEvent{}
+		if err := cloudEvent.UnmarshalJSON(msg.Value); err != nil {
+			return nil, err
+		}
+		return cloudEvent, nil
+	}
+
+	cloudEvent := &messaging.CloudEvent{
+		Data:       msg.Value,
+		Extensions: map[string]string{},
+	}
+	cloudEvent.DataContentType, _ = HeaderValue(msg, HeaderContentType)
+	for _, header := range msg.Headers {
+		if !strings.HasPrefix(header.Key, cloudEventsHeaderPrefix) {
+			continue
+		}
+		value := string(header.Value)
+		switch name := strings.TrimPrefix(header.Key, cloudEventsHeaderPrefix); name {
+		case "specversion":
+			cloudEvent.SpecVersion = value
+		case "id":
+			cloudEvent.ID = value
+		case "source":
+			cloudEvent.Source = value
+		case "type":
+			cloudEvent.Type = value
+		case "subject":
+			cloudEvent.Subject = value
+		case "time":
+			at, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, err
+			}
+			cloudEvent.Time = &at
+		default:
+			cloudEvent.Extensions[name] = value
+		}
+	}
+	return cloudEvent, nil
+}
+
+// NewEventsFromMessage decodes the events of msg like messaging.NewEventsFromPayload, CloudEvents
+// are unwrapped first. Unlike messaging.NewEventsFromTemplate it reads headers, so it also decodes
+// events sent in the binary mode.
+func NewEventsFromMessage(ctx context.Context, msg *kafka.Message, eventTemplates map[string]messaging.EventsTemplate) ([]interface{}, error) {
+	data, contentType, eventType, err := eventPayload(msg)
+	if err != nil {
+		return nil, err
+	}
+	return messaging.NewEventsFromPayload(ctx, data, contentType, eventType, eventTemplates)
+}
+
+// eventPayload returns the data, content type and type of the event in msg. CloudEvents are
+// typed by their type attribute, other events by the event type header or their `type` field.
+func eventPayload(msg *kafka.Message) ([]byte, string, string, error) {
+	cloudEvent, err := CloudEventFromMessage(msg)
+	if err == nil {
+		contentType := cloudEvent.DataContentType
+		if contentType == "" {
+			contentType = messaging.JSONContentType
+		}
+		return cloudEvent.Data, contentType, cloudEvent.Type, nil
+	}
+	if err != ErrNotCloudEvent {
+		return nil, "", "", err
+	}
+
+	contentType, _ := HeaderValue(msg, HeaderContentType)
+	eventType, err := peekEventType(msg, contentType)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return msg.Value, contentType, eventType, nil
+}
@@ -0,0 +1,136 @@
+package kmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/google/uuid"
+	"reflect"
+	"testing"
+)
+
+func TestCloudEventRoundTrip(t *testing.T) {
+	actorID := uuid.New()
+	event := jsonEvent(`{"type":"OrderPlaced","id":"42","aggregateId":"42","actorId":"` + actorID.String() + `"}`)
+
+	tests := []struct {
+		name        string
+		mode        CloudEventsMode
+		contentType string
+	}{
+		{name: "Structured mode", mode: CloudEventsStructured, contentType: messaging.CloudEventsContentType},
+		{name: "Binary mode", mode: CloudEventsBinary, contentType: messaging.JSONContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer(), WithCloudEvents(tt.mode, "billing"))
+			outboxORM, err := newOutboxORM(context.Background(), "orders", nil, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = producer.ProduceMessage(context.Background(), outboxORM); err != nil {
+				t.Fatal(err)
+			}
+			msg := broker.Messages("orders")[0]
+
+			if contentType, _ := HeaderValue(msg, HeaderContentType); contentType != tt.contentType {
+				t.Errorf("TestCloudEventRoundTrip(): content type\ngot= \t%v\nwant = \t%v", contentType, tt.contentType)
+			}
+			var value map[string]interface{}
+			if err = json.Unmarshal(msg.Value, &value); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := value["trace"]; ok {
+				t.Errorf("TestCloudEventRoundTrip(): legacy trace\ngot= \t%v\nwant = \t%v", value["trace"], nil)
+			}
+
+			cloudEvent, err := CloudEventFromMessage(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			attributes := []string{cloudEvent.Type, cloudEvent.Subject, cloudEvent.Source}
+			if want := []string{"OrderPlaced", "42", "billing"}; !reflect.DeepEqual(attributes, want) {
+				t.Errorf("TestCloudEventRoundTrip(): CloudEventFromMessage attributes\ngot= \t%v\nwant = \t%v", attributes, want)
+			}
+			if string(cloudEvent.Data) != string(event) {
+				t.Errorf("TestCloudEventRoundTrip(): CloudEventFromMessage data\ngot= \t%v\nwant = \t%v", string(cloudEvent.Data), event)
+			}
+			baggage, err := cloudEvent.Baggage()
+			if err != nil || baggage.ActorID == nil || *baggage.ActorID != actorID {
+				t.Errorf("TestCloudEventRoundTrip(): Baggage\ngot= \t%v\nwant = \t%v", baggage, actorID)
+			}
+
+			events, err := NewEventsFromMessage(context.Background(), msg, map[string]messaging.EventsTemplate{
+				"OrderPlaced": {Template: &orderPlaced{}, Flatten: func(data interface{}) []interface{} {
+					return []interface{}{data}
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []interface{}{&orderPlaced{Type: "OrderPlaced", ID: "42"}}
+			if !reflect.DeepEqual(events, want) {
+				t.Errorf("TestCloudEventRoundTrip(): NewEventsFromMessage\ngot= \t%v\nwant = \t%v", events, want)
+			}
+		})
+	}
+}
+
+func TestCloudEventsDisabled(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	event := `{"type":"OrderPlaced","id":"42"}`
+	if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: event}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := CloudEventFromMessage(broker.Messages("orders")[0]); err != ErrNotCloudEvent {
+		t.Errorf("TestCloudEventsDisabled(): CloudEventFromMessage\ngot= \t%v\nwant = \t%v", err, ErrNotCloudEvent)
+	}
+}
+
+func TestCloudEventRepublished(t *testing.T) {
+	event := jsonEvent(`{"type":"OrderPlaced","aggregateId":"42"}`)
+	sent, err := newOutboxORM(context.Background(), "orders", nil, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		outboxORM *OutboxORM
+		id        string
+	}{
+		{name: "Id and time stored when sent", outboxORM: sent, id: sent.KafkaHeaders[HeaderMessageID]},
+		{name: "Row sent without them", outboxORM: &OutboxORM{ID: 7, KafkaTopic: "orders", KafkaKey: "42", KafkaValue: string(event)}, id: "7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer(), WithCloudEvents(CloudEventsStructured, "billing"))
+			// the relay publishes a row again when it couldn't delete it
+			for i := 0; i < 2; i++ {
+				if err := producer.ProduceMessage(context.Background(), tt.outboxORM); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var published []*messaging.CloudEvent
+			for _, msg := range broker.Messages("orders") {
+				cloudEvent, err := CloudEventFromMessage(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				published = append(published, cloudEvent)
+			}
+			if published[0].ID != tt.id || published[1].ID != tt.id {
+				t.Errorf("TestCloudEventRepublished(): ids\ngot= \t%v %v\nwant = \t%v", published[0].ID, published[1].ID, tt.id)
+			}
+			if tt.outboxORM.KafkaHeaders != nil && !published[0].Time.Equal(*published[1].Time) {
+				t.Errorf("TestCloudEventRepublished(): times\ngot= \t%v\nwant = \t%v", published[1].Time, published[0].Time)
+			}
+		})
+	}
+}
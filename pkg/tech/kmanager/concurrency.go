@@ -0,0 +1,185 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	// RevokeDrainTimeout bounds how long in flight messages of revoked partitions
+	// may take, unfinished ones are abandoned and redelivered to the new owner
+	RevokeDrainTimeout = 30 * time.Second
+
+	workerQueueSize = 64
+	// backlogReadTimeout bounds reads while messages wait for a full worker queue
+	backlogReadTimeout = 100 * time.Millisecond
+)
+
+// WithConcurrency processes messages on the given number of workers.
+// Messages sharing a key are always handled by the same worker, keeping their order.
+func WithConcurrency(workers int) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.workers = workers
+	}
+}
+
+type workerTask struct {
+	msg   *kafka.Message
+	state *retryState
+	// owner is the tracked partition the message was consumed for, tasks whose
+	// partition was revoked since are skipped
+	owner *partitionOffsets
+}
+
+type workerPool struct {
+	queues  []chan workerTask
+	tracker *offsetTracker
+	// backlog holds messages of partitions paused because their worker queue was full,
+	// it is only used from the consumer loop
+	backlog map[string][]workerTask
+	quit    chan bool
+	errs    chan error
+	wg      sync.WaitGroup
+}
+
+func (mc *MessageConsumer) startWorkers(ctx context.Context, handleMessage TopicHandler) *workerPool {
+	pool := &workerPool{
+		queues:  make([]chan workerTask, mc.workers),
+		tracker: newOffsetTracker(ctx),
+		backlog: map[string][]workerTask{},
+		quit:    make(chan bool),
+		errs:    make(chan error, 1),
+	}
+	for i := range pool.queues {
+		queue := make(chan workerTask, workerQueueSize)
+		pool.queues[i] = queue
+		pool.wg.Add(1)
+		go func() {
+			defer pool.wg.Done()
+			for task := range queue {
+				select {
+				case <-pool.quit:
+					// shutting down, leave the rest for redelivery
+					continue
+				default:
+				}
+				if !pool.tracker.begin(task.owner) {
+					// partition was revoked, its new owner handles the message
+					continue
+				}
+				err := mc.handle(task.owner.ctx, task.msg, task.state, handleMessage, pool.quit)
+				if err == nil {
+					pool.tracker.complete(task.owner, task.msg.TopicPartition.Offset)
+				} else if err != errConsumerStopped {
+					pool.fail(err)
+				}
+				pool.tracker.end(task.owner)
+			}
+		}()
+	}
+	return pool
+}
+
+// dispatch hands msg to the worker of its key without blocking the consumer loop,
+// when the worker is busy the partition is paused until its backlog is drained
+func (mc *MessageConsumer) dispatch(msg *kafka.Message, state *retryState) error {
+	p := mc.pool
+	owner := p.tracker.track(msg.TopicPartition)
+
+	task := workerTask{msg: msg, state: state, owner: owner}
+	key := partitionKey(msg.TopicPartition)
+	if backlog, ok := p.backlog[key]; ok {
+		// keep the order of the partition behind its backlog
+		p.backlog[key] = append(backlog, task)
+		return nil
+	}
+	if p.offer(task) {
+		return nil
+	}
+	p.backlog[key] = []workerTask{task}
+	return mc.consumer.Pause([]kafka.TopicPartition{msg.TopicPartition})
+}
+
+// drainBacklog moves backlogged messages to workers with free room,
+// partitions are resumed once their backlog is empty
+func (mc *MessageConsumer) drainBacklog(ctx context.Context) {
+	if mc.pool == nil {
+		return
+	}
+	p := mc.pool
+	for key, backlog := range p.backlog {
+		tp := backlog[0].msg.TopicPartition
+		for len(backlog) != 0 && p.offer(backlog[0]) {
+			backlog = backlog[1:]
+		}
+		if len(backlog) != 0 {
+			p.backlog[key] = backlog
+			continue
+		}
+		delete(p.backlog, key)
+		if mc.isPaused(tp) {
+			// waiting for a retry to become due
+			continue
+		}
+		if err := mc.consumer.Resume([]kafka.TopicPartition{tp}); err != nil {
+			log := ctxlogrus.Extract(ctx)
+			log.Warnf("couldn't resume partition %v", err)
+		}
+	}
+}
+
+func (p *workerPool) offer(task workerTask) bool {
+	hash := fnv.New32a()
+	_, _ = hash.Write(task.msg.Key)
+	select {
+	case p.queues[hash.Sum32()%uint32(len(p.queues))] <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// dropBacklog discards the backlog of revoked partitions, their messages were never handed to workers
+func (p *workerPool) dropBacklog(partitions []kafka.TopicPartition) {
+	for _, tp := range partitions {
+		key := partitionKey(tp)
+		if backlog, ok := p.backlog[key]; ok {
+			p.tracker.untrack(backlog[0].msg.TopicPartition)
+			delete(p.backlog, key)
+		}
+	}
+}
+
+func (p *workerPool) fail(err error) {
+	select {
+	case p.errs <- err:
+	default:
+		// an error is already reported
+	}
+}
+
+func (p *workerPool) stop() {
+	close(p.quit)
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+func (mc *MessageConsumer) commitCompleted(ctx context.Context) {
+	if mc.pool == nil {
+		return
+	}
+	offsets := mc.pool.tracker.commitable()
+	if len(offsets) == 0 {
+		return
+	}
+	if _, err := mc.consumer.CommitOffsets(offsets); err != nil {
+		log := ctxlogrus.Extract(ctx)
+		log.Warnf("couldn't commit offsets %v", err)
+	}
+}
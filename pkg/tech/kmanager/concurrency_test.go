@@ -0,0 +1,76 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConcurrencyFullQueue(t *testing.T) {
+	workerQueueSize = 1
+	defer func() {
+		workerQueueSize = 64
+	}()
+
+	// with two partitions and two workers both are picked by the same hash of the key
+	slowKey, fastKey := "a", "b"
+	broker := kafkatest.NewBroker()
+	broker.CreateTopic("orders", 2)
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	for i := 0; i < 5; i++ {
+		if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: slowKey, KafkaValue: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: fastKey, KafkaValue: "fast"}); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan bool)
+	handledFast := make(chan bool)
+	var mu sync.Mutex
+	var slow []string
+	handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		if string(msg.Key) == fastKey {
+			close(handledFast)
+			return nil
+		}
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		slow = append(slow, string(msg.Value))
+		return nil
+	}
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"},
+		WithConcurrency(2), WithRetryPolicy(NoRetries()))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mc.Start(context.Background(), handler)
+	}()
+	// the fast key is handled while the queue of the slow one is full
+	<-handledFast
+	close(release)
+
+	slowPartition := broker.Messages("orders")[0].TopicPartition.Partition
+	waitFor(t, func() bool {
+		return broker.Committed("billing", "orders", slowPartition) == 5
+	})
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"0", "1", "2", "3", "4"}
+	if !reflect.DeepEqual(slow, want) {
+		t.Errorf("TestConcurrencyFullQueue(): order of the slow key\ngot= \t%v\nwant = \t%v", slow, want)
+	}
+}
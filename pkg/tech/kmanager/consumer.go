@@ -6,42 +6,79 @@ import (
 	"github.com/Cobalt0s/creme-brulee/pkg/stateful/config"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"go.opentelemetry.io/otel/codes"
 	"gorm.io/gorm"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	DeadLetterQueueTopic = "DLQ"
-	retryTimeouts        = []int{0, 2, 4, 8, 16}
 )
 
 type MessageConsumer struct {
-	consumer    *kafka.Consumer
+	consumer    KafkaConsumer
 	topicNames  []string
 	db          *gorm.DB
 	arguments   *messaging.ContextualArguments
-	stop        chan bool
 	dlqProducer *MessageProducer
+	retryPolicy RetryPolicy
+	middlewares []Middleware
+
+	batchMiddlewares []BatchMiddleware
+
+	consumerGroup string
+	idempotent    bool
+
+	retryTiers    []RetryTier
+	retryTopics   map[string]int
+	pausedRetries map[string]pausedRetry
+
+	workers int
+	pool    *workerPool
+	batch   *batcher
+	hooks   RebalanceHooks
+	metrics *Metrics
+
+	stop          chan bool
+	stopOnce      sync.Once
+	done          chan bool
+	started       int32
+	drainTimedOut int32
+	drainTimeout  time.Duration
 }
 
-type KafkaHealthChecker struct {
-	consumer *kafka.Consumer
+type ConsumerOption func(mc *MessageConsumer)
+
+// WithRetryPolicy replaces DefaultRetryPolicy used for failed handlers
+func WithRetryPolicy(policy RetryPolicy) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.retryPolicy = policy
+	}
 }
 
-func NewMessageConsumer(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, cfg *config.KafkaConfig, clientID, consumerGroup string, topicNames []string) *MessageConsumer {
-	return createFailsafeMessageConsumer(ctx, arguments, db, cfg, clientID, consumerGroup, topicNames, false)
+// WithRetryTopics forwards failed messages through retry tier topics instead of
+// retrying them in place, the DLQ is used once the last tier has failed as well.
+// Without tiers DefaultRetryTiers are used.
+func WithRetryTopics(tiers ...RetryTier) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		if len(tiers) == 0 {
+			tiers = DefaultRetryTiers
+		}
+		mc.retryTiers = tiers
+	}
 }
 
-func NewMessageConsumerOrigin(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, cfg *config.KafkaConfig, clientID, consumerGroup string, topicNames []string) *MessageConsumer {
-	return createFailsafeMessageConsumer(ctx, arguments, db, cfg, clientID, consumerGroup, topicNames, true)
+func NewMessageConsumer(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, cfg *config.KafkaConfig, clientID, consumerGroup string, topicNames []string, opts ...ConsumerOption) *MessageConsumer {
+	return createFailsafeMessageConsumer(ctx, arguments, db, cfg, clientID, consumerGroup, topicNames, false, opts)
 }
 
-func (mc *MessageConsumer) Close() error {
-	mc.stop <- true
-	return mc.consumer.Close()
+func NewMessageConsumerOrigin(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, cfg *config.KafkaConfig, clientID, consumerGroup string, topicNames []string, opts ...ConsumerOption) *MessageConsumer {
+	return createFailsafeMessageConsumer(ctx, arguments, db, cfg, clientID, consumerGroup, topicNames, true, opts)
 }
 
-func createFailsafeMessageConsumer(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, cfg *config.KafkaConfig, clientID, consumerGroup string, topicNames []string, origin bool) *MessageConsumer {
+func createFailsafeMessageConsumer(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, cfg *config.KafkaConfig, clientID, consumerGroup string, topicNames []string, origin bool, opts []ConsumerOption) *MessageConsumer {
 	log := ctxlogrus.Extract(ctx)
 
 	kc, err := kafka.NewConsumer(getConsumerMap(origin, cfg, clientID, consumerGroup))
@@ -52,14 +89,51 @@ func createFailsafeMessageConsumer(ctx context.Context, arguments *messaging.Con
 	if err != nil {
 		log.Fatal(err)
 	}
+	return NewMessageConsumerFromClients(arguments, db, kc, dlqProducer, consumerGroup, topicNames, opts...)
+}
 
-	return &MessageConsumer{
-		consumer:    kc,
-		topicNames:  topicNames,
+// NewMessageConsumerFromClients builds a consumer on top of existing kafka clients,
+// such as the in memory ones of kafkatest
+func NewMessageConsumerFromClients(arguments *messaging.ContextualArguments, db *gorm.DB, consumer KafkaConsumer, dlqProducer *MessageProducer, consumerGroup string, topicNames []string, opts ...ConsumerOption) *MessageConsumer {
+	mc := &MessageConsumer{
+		consumer:    consumer,
 		db:          db,
 		arguments:   arguments,
-		stop:        make(chan bool),
 		dlqProducer: dlqProducer,
+
+		consumerGroup: consumerGroup,
+
+		pausedRetries: map[string]pausedRetry{},
+
+		stop:         make(chan bool),
+		done:         make(chan bool),
+		drainTimeout: DefaultDrainTimeout,
+	}
+	for _, opt := range opts {
+		opt(mc)
+	}
+	if mc.metrics != nil {
+		dlqProducer.metrics = mc.metrics
+	}
+	if mc.retryPolicy == nil {
+		if len(mc.retryTiers) != 0 {
+			// retry tiers take over retrying
+			mc.retryPolicy = NoRetries()
+		} else {
+			mc.retryPolicy = DefaultRetryPolicy()
+		}
+	}
+	mc.subscribeTo(topicNames)
+	return mc
+}
+
+func (mc *MessageConsumer) subscribeTo(topicNames []string) {
+	mc.topicNames = topicNames
+	mc.retryTopics = map[string]int{}
+	for _, topic := range topicNames {
+		for i, tier := range mc.retryTiers {
+			mc.retryTopics[tier.TopicFor(topic)] = i
+		}
 	}
 }
 
@@ -73,45 +147,104 @@ func getConsumerMap(origin bool, cfg *config.KafkaConfig, clientID, consumerGrou
 type TopicHandler func(ctx context.Context, arguments *messaging.ContextualArguments,
 	db *gorm.DB, msg *kafka.Message) error
 
+// Start consumes messages until ctx is done or the consumer is closed, in flight messages
+// are drained before it returns. ErrDrainTimeout is returned when messages had to be abandoned,
+// a consumer can only be started once and not after it was closed.
 func (mc *MessageConsumer) Start(ctx context.Context, handleMessage TopicHandler) error {
+	return mc.run(ctx, handleMessage, nil)
+}
+
+// run is the consumer loop, messages are collected by batch when it is set
+func (mc *MessageConsumer) run(ctx context.Context, handleMessage TopicHandler, batch *batcher) (err error) {
 	log := ctxlogrus.Extract(ctx)
+	if !atomic.CompareAndSwapInt32(&mc.started, 0, 1) {
+		if mc.isStopped() {
+			return ErrConsumerClosed
+		}
+		return ErrConsumerStarted
+	}
+	defer close(mc.done)
+	if mc.isStopped() {
+		// closed while starting, Close waits for done before releasing the clients
+		return nil
+	}
 	log.Info("starting kafka consumer")
 
-	if err := mc.consumer.SubscribeTopics(mc.topicNames, nil); err != nil {
+	defer func() {
+		if err == nil && atomic.LoadInt32(&mc.drainTimedOut) == 1 {
+			err = ErrDrainTimeout
+		}
+	}()
+	handlerCtx, cancelHandlers := context.WithCancel(detachedContext{parent: ctx})
+	defer cancelHandlers()
+	go mc.superviseShutdown(ctx, cancelHandlers)
+	ctx = handlerCtx
+	handleMessage = Chain(handleMessage, mc.handlerMiddlewares()...)
+	if batch != nil {
+		batch.retry = handleMessage
+		mc.batch = batch
+		defer func() {
+			mc.batch = nil
+		}()
+	}
+
+	var errs chan error
+	if mc.workers > 1 && batch == nil {
+		mc.pool = mc.startWorkers(ctx, handleMessage)
+		errs = mc.pool.errs
+		defer func() {
+			mc.pool.stop()
+			mc.commitCompleted(ctx)
+			mc.pool = nil
+		}()
+	}
+
+	if err := mc.checkRetryTopics(); err != nil {
+		log.Errorf("failed checking retry tier topics %v", err)
+		return err
+	}
+	topicNames := append(RetryTopicNames(mc.topicNames, mc.retryTiers), mc.topicNames...)
+	if err := mc.consumer.SubscribeTopics(topicNames, mc.rebalance(ctx)); err != nil {
 		log.Errorf("failed to subscirbe to kafka topics %v", err)
 		return err
 	}
+	stopSampling := mc.metrics.sampleLag(mc.consumer)
+	defer stopSampling()
 
 	for {
 		select {
 		case <-mc.stop:
 			log.Info("stopping message consumer")
-			return nil
+			return mc.drainBatch(ctx, batch)
+		case err := <-errs:
+			return err
 		default:
-			if msg, err := mc.consumer.ReadMessage(5 * time.Second); err == nil {
-				if len(msg.Key) != 0 { // ignore heartbeat messages
-					for _, retryTimeout := range retryTimeouts {
-						waitTime := time.Duration(retryTimeout) * time.Second
-						time.Sleep(waitTime)
-						err := handleMessage(ctx, mc.arguments, mc.db, msg)
-						if err != nil {
-							if retryTimeout != retryTimeouts[len(retryTimeouts)-1] {
-								log.Error("failed processing event, will retry")
-							} else {
-								log.Error("failed processing event, reached final retry")
-								if dlqErr := mc.dlqProducer.ProduceMessage(ctx, &DLQMessage{
-									MessageValue: msg.Value,
-									FormerTopic:  msg.TopicPartition.Topic,
-								}); dlqErr != nil {
-									return dlqErr
-								}
-							}
-						} else {
-							break
-						}
+			mc.resumeDueRetries(ctx)
+			mc.drainBacklog(ctx)
+			mc.commitCompleted(ctx)
+			readTimeout := 5 * time.Second
+			if mc.pool != nil && len(mc.pool.backlog) != 0 {
+				readTimeout = backlogReadTimeout
+			}
+			if batch != nil {
+				if err := batch.flushIfDue(ctx); err != nil {
+					return err
+				}
+				readTimeout = batch.readTimeout(readTimeout)
+			}
+			if msg, err := mc.consumer.ReadMessage(readTimeout); err == nil {
+				if len(msg.Key) != 0 && !mc.isPaused(msg.TopicPartition) { // ignore heartbeat messages
+					if batch != nil {
+						err = batch.add(ctx, msg)
+					} else {
+						err = mc.consume(ctx, msg, handleMessage)
 					}
-					if _, err := mc.consumer.CommitMessage(msg); err != nil {
-						log.Warnf("couldn't commit message %v", err)
+					if err != nil {
+						if err == errConsumerStopped {
+							log.Info("stopping message consumer")
+							return nil
+						}
+						return err
 					}
 				}
 			} else {
@@ -126,3 +259,106 @@ func (mc *MessageConsumer) Start(ctx context.Context, handleMessage TopicHandler
 		}
 	}
 }
+
+// drainBatch handles the pending batch before stopping, handlers are cancelled once the
+// drain timeout passes and the messages left are redelivered
+func (mc *MessageConsumer) drainBatch(ctx context.Context, batch *batcher) error {
+	if batch == nil {
+		return nil
+	}
+	if err := batch.drain(ctx, nil); err != nil && err != errConsumerStopped {
+		return err
+	}
+	return nil
+}
+
+func (mc *MessageConsumer) consume(ctx context.Context, msg *kafka.Message, handleMessage TopicHandler) error {
+	state, err := mc.retryStateOf(msg)
+	if err == errRetryNotDue {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if mc.pool != nil {
+		return mc.dispatch(msg, state)
+	}
+	ctx, committed := withTransactionCommit(ctx)
+	if err = mc.handle(ctx, msg, state, handleMessage, mc.stop); err != nil {
+		return err
+	}
+	if *committed {
+		// the transaction of Transform committed the offset along with its output
+		return nil
+	}
+	if _, err = mc.consumer.CommitMessage(msg); err != nil {
+		log := ctxlogrus.Extract(ctx)
+		log.Warnf("couldn't commit message %v", err)
+	}
+	return nil
+}
+
+func (mc *MessageConsumer) handle(ctx context.Context, msg *kafka.Message, state *retryState, handleMessage TopicHandler, stop <-chan bool) error {
+	msg = state.restore(msg)
+
+	ctx, span := TraceFromMessageNamed(ctx, msg, "EventConsumed")
+	defer span.End()
+	ctx = consumerTraced(ctx)
+	log := ctxlogrus.Extract(ctx)
+
+	attempts, handlerErr, err := mc.processWithRetries(ctx, msg, handleMessage, stop)
+	if err != nil || handlerErr == nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		// handler was cancelled by the drain timeout, the message is left for redelivery
+		return errConsumerStopped
+	}
+	span.SetStatus(codes.Error, "failed processing event")
+	attempts += state.attempts
+
+	if state.tier < len(mc.retryTiers) && !IsPermanent(handlerErr) {
+		tier := mc.retryTiers[state.tier]
+		log.Errorf("failed processing event, will retry in %v: %v", tier.Delay, handlerErr)
+		mc.metrics.retried(*msg.TopicPartition.Topic)
+		return mc.dlqProducer.ProduceMessage(ctx, newRetryMessage(msg, tier, attempts))
+	}
+	log.Errorf("failed processing event after %v attempts, sending to DLQ: %v", attempts, handlerErr)
+	mc.metrics.deadLettered(*msg.TopicPartition.Topic)
+	return mc.dlqProducer.ProduceMessage(ctx, NewDLQMessage(msg, handlerErr, attempts))
+}
+
+func (mc *MessageConsumer) handlerMiddlewares() []Middleware {
+	middlewares := append([]Middleware{}, mc.middlewares...)
+	if mc.idempotent {
+		// innermost so the ledger transaction holds nothing but the handler
+		middlewares = append(middlewares, IdempotencyMiddleware(mc.consumerGroup))
+	}
+	return middlewares
+}
+
+// processWithRetries retries the handler in place following the retry policy,
+// it returns the last handler error once the policy gives up
+func (mc *MessageConsumer) processWithRetries(ctx context.Context, msg *kafka.Message, handleMessage TopicHandler, stop <-chan bool) (int, error, error) {
+	log := ctxlogrus.Extract(ctx)
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		handlerErr := handleMessage(ctx, mc.arguments, mc.db, msg)
+		mc.metrics.observeHandler(*msg.TopicPartition.Topic, time.Since(started), handlerErr)
+		if handlerErr == nil {
+			return attempt, nil, nil
+		}
+		backoff, retry := mc.retryPolicy.NextBackoff(attempt, time.Since(start), handlerErr)
+		if !retry {
+			return attempt, handlerErr, nil
+		}
+		log.Errorf("failed processing event, will retry in %v: %v", backoff, handlerErr)
+		mc.metrics.retried(*msg.TopicPartition.Topic)
+		if err := sleep(ctx, stop, backoff); err != nil {
+			return attempt, handlerErr, err
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package kmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	_ KafkaConsumer = (*kafkatest.Consumer)(nil)
+	_ KafkaProducer = (*kafkatest.Producer)(nil)
+)
+
+func TestMessageConsumer(t *testing.T) {
+	quickRetries := &ExponentialBackoff{MaxAttempts: 3, InitialInterval: time.Millisecond}
+	tier := RetryTier{Delay: 20 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		opts     []ConsumerOption
+		failures int32
+		calls    int32
+		retried  int
+		attempts int
+	}{
+		{
+			name:  "Handled message is committed",
+			opts:  []ConsumerOption{WithRetryPolicy(NoRetries())},
+			calls: 1,
+		},
+		{
+			name:     "Failed message goes to the DLQ",
+			opts:     []ConsumerOption{WithRetryPolicy(NoRetries())},
+			failures: 1,
+			calls:    1,
+			attempts: 1,
+		},
+		{
+			name:     "Retried in place",
+			opts:     []ConsumerOption{WithRetryPolicy(quickRetries)},
+			failures: 2,
+			calls:    3,
+		},
+		{
+			name:     "Retries exhausted",
+			opts:     []ConsumerOption{WithRetryPolicy(quickRetries)},
+			failures: 5,
+			calls:    3,
+			attempts: 3,
+		},
+		{
+			name:     "Retry topic before the DLQ",
+			opts:     []ConsumerOption{WithRetryTopics(tier)},
+			failures: 5,
+			calls:    2,
+			retried:  1,
+			attempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			broker.CreateTopic(tier.TopicFor("orders"), 1)
+			producer := NewMessageProducerFromClient(broker.NewProducer())
+			if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}); err != nil {
+				t.Fatal(err)
+			}
+
+			var calls int32
+			handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				if atomic.AddInt32(&calls, 1) <= tt.failures {
+					return errors.New("handler failed")
+				}
+				return nil
+			}
+			dlqProducer := NewMessageProducerFromClient(broker.NewProducer())
+			mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), dlqProducer, "billing", []string{"orders"}, tt.opts...)
+
+			deadLetters := 0
+			if tt.attempts != 0 {
+				deadLetters = 1
+			}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- mc.Start(context.Background(), handler)
+			}()
+			waitFor(t, func() bool {
+				return atomic.LoadInt32(&calls) == tt.calls &&
+					broker.Committed("billing", "orders", 0) == 1 &&
+					len(broker.Messages(DeadLetterQueueTopic)) == deadLetters
+			})
+			if err := mc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if calls != tt.calls {
+				t.Fatalf("TestMessageConsumer(): calls\ngot= \t%v\nwant = \t%v", calls, tt.calls)
+			}
+			retries := broker.Messages(tier.TopicFor("orders"))
+			if len(retries) != tt.retried {
+				t.Fatalf("TestMessageConsumer(): retry messages\ngot= \t%v\nwant = \t%v", len(retries), tt.retried)
+			}
+			if tt.retried != 0 {
+				if offset := broker.Committed("billing", tier.TopicFor("orders"), 0); offset != 1 {
+					t.Fatalf("TestMessageConsumer(): retry offset\ngot= \t%v\nwant = \t%v", offset, 1)
+				}
+			}
+			if tt.attempts == 0 {
+				return
+			}
+			envelope := &DLQEnvelope{}
+			if err := json.Unmarshal(broker.Messages(DeadLetterQueueTopic)[0].Value, envelope); err != nil {
+				t.Fatal(err)
+			}
+			if envelope.OriginalTopic != "orders" || string(envelope.Value) != "placed" || envelope.Offset != 0 {
+				t.Fatalf("TestMessageConsumer(): dead letter\ngot= \t%v %s %v\nwant = \t%v %s %v",
+					envelope.OriginalTopic, envelope.Value, envelope.Offset, "orders", "placed", 0)
+			}
+			if envelope.Attempts != tt.attempts {
+				t.Fatalf("TestMessageConsumer(): attempts\ngot= \t%v\nwant = \t%v", envelope.Attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestProduceTransaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		failTopic string
+		messages  int
+		committed kafka.Offset
+	}{
+		{name: "Messages and offsets are committed together", messages: 2, committed: 1},
+		{name: "Nothing is committed on failure", failTopic: "invoices", messages: 0, committed: kafka.OffsetInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			if tt.failTopic != "" {
+				broker.FailProduce(tt.failTopic, kafka.NewError(kafka.ErrMsgSizeTooLarge, "too large", false))
+			}
+			consumer := broker.NewConsumer("billing")
+			producer, err := NewTransactionalMessageProducerFromClient(context.Background(), broker.NewProducer())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			orders := "orders"
+			messages := []Message{
+				&OutboxORM{KafkaTopic: "receipts", KafkaKey: "42", KafkaValue: "sent"},
+				&OutboxORM{KafkaTopic: "invoices", KafkaKey: "42", KafkaValue: "issued"},
+			}
+			offsets := []kafka.TopicPartition{{Topic: &orders, Partition: 0, Offset: 1}}
+			err = producer.ProduceTransaction(context.Background(), messages, consumer, offsets)
+			if (err != nil) != (tt.failTopic != "") {
+				t.Fatalf("TestProduceTransaction(): error\ngot= \t%v\nwant = \t%v", err, tt.failTopic != "")
+			}
+
+			produced := len(broker.Messages("receipts")) + len(broker.Messages("invoices"))
+			if produced != tt.messages {
+				t.Fatalf("TestProduceTransaction(): messages\ngot= \t%v\nwant = \t%v", produced, tt.messages)
+			}
+			if offset := broker.Committed("billing", orders, 0); offset != tt.committed {
+				t.Fatalf("TestProduceTransaction(): offset\ngot= \t%v\nwant = \t%v", offset, tt.committed)
+			}
+		})
+	}
+}
+
+func TestStartTransformConcurrency(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	producer, err := NewTransactionalMessageProducerFromClient(context.Background(), broker.NewProducer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"}, WithConcurrency(4))
+
+	err = mc.StartTransform(context.Background(), producer, func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) ([]Message, error) {
+		return nil, nil
+	})
+	if !errors.Is(err, ErrTransformOption) {
+		t.Errorf("TestStartTransformConcurrency(): StartTransform\ngot= \t%v\nwant = \t%v", err, ErrTransformOption)
+	}
+}
+
+// commitCounter counts the offsets committed outside of transactions
+type commitCounter struct {
+	*kafkatest.Consumer
+	commits int32
+}
+
+func (c *commitCounter) CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error) {
+	atomic.AddInt32(&c.commits, 1)
+	return c.Consumer.CommitMessage(msg)
+}
+
+func TestStartTransform(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		receipts    int
+		deadLetters int
+		commits     int32
+	}{
+		{name: "Transformed message is committed by its transaction", receipts: 1},
+		{name: "Dead lettered message is committed by the consumer", err: errors.New("invalid order"), deadLetters: 1, commits: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer, err := NewTransactionalMessageProducerFromClient(context.Background(), broker.NewProducer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}); err != nil {
+				t.Fatal(err)
+			}
+			consumer := &commitCounter{Consumer: broker.NewConsumer("billing")}
+			mc := NewMessageConsumerFromClients(nil, nil, consumer, NewMessageProducerFromClient(broker.NewProducer()), "billing", []string{"orders"},
+				WithRetryPolicy(NoRetries()))
+
+			errs := make(chan error, 1)
+			go func() {
+				errs <- mc.StartTransform(context.Background(), producer, func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) ([]Message, error) {
+					return []Message{&OutboxORM{KafkaTopic: "receipts", KafkaKey: "42", KafkaValue: "sent"}}, tt.err
+				})
+			}()
+			waitFor(t, func() bool {
+				return broker.Committed("billing", "orders", 0) == 1
+			})
+			if err = mc.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if err = <-errs; err != nil {
+				t.Fatal(err)
+			}
+
+			if receipts := len(broker.Messages("receipts")); receipts != tt.receipts {
+				t.Errorf("TestStartTransform(): receipts\ngot= \t%v\nwant = \t%v", receipts, tt.receipts)
+			}
+			if deadLetters := len(broker.Messages(DeadLetterQueueTopic)); deadLetters != tt.deadLetters {
+				t.Errorf("TestStartTransform(): dead letters\ngot= \t%v\nwant = \t%v", deadLetters, tt.deadLetters)
+			}
+			if commits := atomic.LoadInt32(&consumer.commits); commits != tt.commits {
+				t.Errorf("TestStartTransform(): commits outside transactions\ngot= \t%v\nwant = \t%v", commits, tt.commits)
+			}
+		})
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
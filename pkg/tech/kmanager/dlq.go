@@ -0,0 +1,244 @@
+package kmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/stateful/config"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"strings"
+	"time"
+)
+
+const (
+	dlqMetadataTimeoutMs = 10000
+)
+
+// DLQEnvelope is the value of every dead letter queue record
+type DLQEnvelope struct {
+	OriginalTopic string                 `json:"originalTopic"`
+	OriginalKey   []byte                 `json:"originalKey"`
+	Partition     int32                  `json:"partition"`
+	Offset        int64                  `json:"offset"`
+	Headers       []DLQHeader            `json:"headers,omitempty"`
+	Value         []byte                 `json:"value"`
+	Error         string                 `json:"error"`
+	Attempts      int                    `json:"attempts"`
+	FailedAt      messaging.TimeNano3339 `json:"failedAt"`
+}
+
+type DLQHeader struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+func NewDLQEnvelope(msg *kafka.Message, handlerErr error, attempts int) *DLQEnvelope {
+	envelope := &DLQEnvelope{
+		OriginalTopic: "unknown_topic",
+		OriginalKey:   msg.Key,
+		Partition:     msg.TopicPartition.Partition,
+		Offset:        int64(msg.TopicPartition.Offset),
+		Headers:       make([]DLQHeader, len(msg.Headers)),
+		Value:         msg.Value,
+		Attempts:      attempts,
+		FailedAt:      messaging.NewNano3339Time(time.Now()),
+	}
+	if msg.TopicPartition.Topic != nil {
+		envelope.OriginalTopic = *msg.TopicPartition.Topic
+	}
+	if handlerErr != nil {
+		envelope.Error = handlerErr.Error()
+	}
+	for i, h := range msg.Headers {
+		envelope.Headers[i] = DLQHeader{Key: h.Key, Value: h.Value}
+	}
+	return envelope
+}
+
+// Original recreates the message as it was consumed from its original topic
+func (e *DLQEnvelope) Original() Message {
+	headers := make([]kafka.Header, 0, len(e.Headers))
+	for _, h := range e.Headers {
+		if !strings.HasPrefix(h.Key, "kmanager-retry-") {
+			headers = append(headers, kafka.Header{Key: h.Key, Value: h.Value})
+		}
+	}
+	return &RetryMessage{
+		topic:   e.OriginalTopic,
+		key:     e.OriginalKey,
+		value:   e.Value,
+		headers: headers,
+	}
+}
+
+type DLQMessage struct {
+	Envelope *DLQEnvelope
+}
+
+func NewDLQMessage(msg *kafka.Message, handlerErr error, attempts int) *DLQMessage {
+	return &DLQMessage{Envelope: NewDLQEnvelope(msg, handlerErr, attempts)}
+}
+
+func (m *DLQMessage) Key() []byte {
+	if len(m.Envelope.OriginalKey) == 0 {
+		return []byte(m.Envelope.OriginalTopic)
+	}
+	return m.Envelope.OriginalKey
+}
+
+func (m *DLQMessage) Value() []byte {
+	value, err := json.Marshal(m.Envelope)
+	if err != nil {
+		// envelope consists of plain fields only, fallback is never expected
+		return m.Envelope.Value
+	}
+	return value
+}
+
+func (m *DLQMessage) Topic() *string {
+	return &DeadLetterQueueTopic
+}
+
+func (m *DLQMessage) Headers() []kafka.Header {
+	return m.Envelope.Original().Headers()
+}
+
+// ReplayFilter selects dead letters, zero valued fields match everything
+type ReplayFilter struct {
+	Topics        []string
+	From          time.Time
+	To            time.Time
+	ErrorContains string
+}
+
+func (f *ReplayFilter) Matches(e *DLQEnvelope) bool {
+	if len(f.Topics) != 0 && !containsString(f.Topics, e.OriginalTopic) {
+		return false
+	}
+	if !f.From.IsZero() && e.FailedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && e.FailedAt.After(f.To) {
+		return false
+	}
+	return strings.Contains(e.Error, f.ErrorContains)
+}
+
+// ReadDeadLetters reads the dead letter queue up to its current end without committing,
+// records which were written before the envelope existed are returned with their raw value
+func ReadDeadLetters(ctx context.Context, cfg *config.KafkaConfig, clientID string, filter *ReplayFilter) ([]*DLQEnvelope, error) {
+	kc, err := kafka.NewConsumer(cfg.GetKafkaConfigMapConsumer(clientID, clientID+"-dlq-reader"))
+	if err != nil {
+		return nil, err
+	}
+	defer kc.Close()
+	return ReadDeadLettersFrom(ctx, kc, filter)
+}
+
+// ReadDeadLettersFrom is ReadDeadLetters over an existing client, such as the in memory one of kafkatest.
+// The client must not be subscribed to topics, its partitions are assigned manually.
+func ReadDeadLettersFrom(ctx context.Context, kc KafkaConsumer, filter *ReplayFilter) ([]*DLQEnvelope, error) {
+	log := ctxlogrus.Extract(ctx)
+
+	metadata, err := kc.GetMetadata(&DeadLetterQueueTopic, false, dlqMetadataTimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	ends := make(map[int32]kafka.Offset)
+	var assignment []kafka.TopicPartition
+	for _, partition := range metadata.Topics[DeadLetterQueueTopic].Partitions {
+		low, high, err := kc.QueryWatermarkOffsets(DeadLetterQueueTopic, partition.ID, dlqMetadataTimeoutMs)
+		if err != nil {
+			return nil, err
+		}
+		if high > low {
+			ends[partition.ID] = kafka.Offset(high)
+			assignment = append(assignment, kafka.TopicPartition{
+				Topic:     &DeadLetterQueueTopic,
+				Partition: partition.ID,
+				Offset:    kafka.Offset(low),
+			})
+		}
+	}
+	if err = kc.Assign(assignment); err != nil {
+		return nil, err
+	}
+
+	var result []*DLQEnvelope
+	for len(ends) != 0 {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		msg, err := kc.ReadMessage(time.Second)
+		if err != nil {
+			if kErr, ok := err.(kafka.Error); ok && kErr.Code() == kafka.ErrTimedOut {
+				continue
+			}
+			return nil, err
+		}
+		partition := msg.TopicPartition.Partition
+		if msg.TopicPartition.Offset+1 >= ends[partition] {
+			delete(ends, partition)
+		}
+
+		envelope := decodeDLQEnvelope(msg)
+		if filter == nil || filter.Matches(envelope) {
+			result = append(result, envelope)
+		}
+	}
+	log.Infof("read %v dead letters", len(result))
+	return result, nil
+}
+
+// ReplayDeadLetters republishes matching dead letters to their original topics
+// returning how many of them were sent
+func ReplayDeadLetters(ctx context.Context, cfg *config.KafkaConfig, clientID string, sender MessageSender, filter *ReplayFilter) (int, error) {
+	envelopes, err := ReadDeadLetters(ctx, cfg, clientID, filter)
+	if err != nil {
+		return 0, err
+	}
+	return replayDeadLetters(ctx, envelopes, sender)
+}
+
+// ReplayDeadLettersFrom is ReplayDeadLetters over an existing client, see ReadDeadLettersFrom
+func ReplayDeadLettersFrom(ctx context.Context, kc KafkaConsumer, sender MessageSender, filter *ReplayFilter) (int, error) {
+	envelopes, err := ReadDeadLettersFrom(ctx, kc, filter)
+	if err != nil {
+		return 0, err
+	}
+	return replayDeadLetters(ctx, envelopes, sender)
+}
+
+func replayDeadLetters(ctx context.Context, envelopes []*DLQEnvelope, sender MessageSender) (int, error) {
+	for i, envelope := range envelopes {
+		if err := sender.ProduceMessage(ctx, envelope.Original()); err != nil {
+			return i, err
+		}
+	}
+	return len(envelopes), nil
+}
+
+func decodeDLQEnvelope(msg *kafka.Message) *DLQEnvelope {
+	envelope := &DLQEnvelope{}
+	if err := json.Unmarshal(msg.Value, envelope); err == nil && envelope.OriginalTopic != "" {
+		return envelope
+	}
+	// legacy record, key holds the former topic
+	return &DLQEnvelope{
+		OriginalTopic: string(msg.Key),
+		Partition:     kafka.PartitionAny,
+		Offset:        int64(kafka.OffsetInvalid),
+		Value:         msg.Value,
+		FailedAt:      messaging.NewNano3339Time(msg.Timestamp),
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
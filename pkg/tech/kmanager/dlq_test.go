@@ -0,0 +1,193 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDLQEnvelope(t *testing.T) {
+	orders := "orders"
+	tests := []struct {
+		name    string
+		msg     *kafka.Message
+		key     string
+		headers []kafka.Header
+	}{
+		{
+			name: "Keyed message",
+			msg: &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: 2, Offset: 11},
+				Key:            []byte("42"),
+				Value:          []byte(`{"type":"OrderPlaced"}`),
+				Headers:        []kafka.Header{{Key: "tenant", Value: []byte("acme")}},
+			},
+			key:     "42",
+			headers: []kafka.Header{{Key: "tenant", Value: []byte("acme")}},
+		},
+		{
+			name: "Retry headers are not replayed",
+			msg: &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: 0, Offset: 3},
+				Key:            []byte("42"),
+				Value:          []byte("placed"),
+				Headers: []kafka.Header{
+					{Key: HeaderRetryAttempts, Value: []byte("2")},
+					{Key: "tenant", Value: []byte("acme")},
+				},
+			},
+			key:     "42",
+			headers: []kafka.Header{{Key: "tenant", Value: []byte("acme")}},
+		},
+		{
+			name: "Message without key is keyed by topic",
+			msg: &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: 0, Offset: 5},
+				Value:          []byte("placed"),
+			},
+			key:     "orders",
+			headers: []kafka.Header{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dlqMessage := NewDLQMessage(tt.msg, errors.New("database is down"), 3)
+			if got := string(dlqMessage.Key()); got != tt.key {
+				t.Errorf("TestDLQEnvelope(): Key\ngot= \t%v\nwant = \t%v", got, tt.key)
+			}
+
+			envelope := decodeDLQEnvelope(&kafka.Message{Key: dlqMessage.Key(), Value: dlqMessage.Value()})
+			want := &DLQEnvelope{
+				OriginalTopic: orders,
+				Partition:     tt.msg.TopicPartition.Partition,
+				Offset:        int64(tt.msg.TopicPartition.Offset),
+				Value:         tt.msg.Value,
+				Error:         "database is down",
+				Attempts:      3,
+			}
+			if envelope.OriginalTopic != want.OriginalTopic || envelope.Partition != want.Partition ||
+				envelope.Offset != want.Offset || string(envelope.Value) != string(want.Value) ||
+				envelope.Error != want.Error || envelope.Attempts != want.Attempts {
+				t.Errorf("TestDLQEnvelope(): decodeDLQEnvelope\ngot= \t%+v\nwant = \t%+v", envelope, want)
+			}
+			if !envelope.FailedAt.Equal(dlqMessage.Envelope.FailedAt.Time) {
+				t.Errorf("TestDLQEnvelope(): FailedAt\ngot= \t%v\nwant = \t%v", envelope.FailedAt, dlqMessage.Envelope.FailedAt)
+			}
+
+			original := envelope.Original()
+			if *original.Topic() != orders || string(original.Key()) != string(tt.msg.Key) || string(original.Value()) != string(tt.msg.Value) {
+				t.Errorf("TestDLQEnvelope(): Original\ngot= \t%v %s %s\nwant = \t%v %s %s",
+					*original.Topic(), original.Key(), original.Value(), orders, tt.msg.Key, tt.msg.Value)
+			}
+			if !reflect.DeepEqual(original.Headers(), tt.headers) {
+				t.Errorf("TestDLQEnvelope(): Original headers\ngot= \t%v\nwant = \t%v", original.Headers(), tt.headers)
+			}
+		})
+	}
+}
+
+func TestDecodeLegacyDLQRecord(t *testing.T) {
+	failedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "Raw value", value: "placed"},
+		{name: "JSON event", value: `{"type":"OrderPlaced"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope := decodeDLQEnvelope(&kafka.Message{Key: []byte("orders"), Value: []byte(tt.value), Timestamp: failedAt})
+			if envelope.OriginalTopic != "orders" || string(envelope.Value) != tt.value {
+				t.Errorf("TestDecodeLegacyDLQRecord(): decodeDLQEnvelope\ngot= \t%v %s\nwant = \t%v %s", envelope.OriginalTopic, envelope.Value, "orders", tt.value)
+			}
+			if envelope.Partition != kafka.PartitionAny || envelope.Offset != int64(kafka.OffsetInvalid) {
+				t.Errorf("TestDecodeLegacyDLQRecord(): position\ngot= \t%v %v\nwant = \t%v %v", envelope.Partition, envelope.Offset, kafka.PartitionAny, kafka.OffsetInvalid)
+			}
+			if !envelope.FailedAt.Equal(failedAt) {
+				t.Errorf("TestDecodeLegacyDLQRecord(): FailedAt\ngot= \t%v\nwant = \t%v", envelope.FailedAt, failedAt)
+			}
+		})
+	}
+}
+
+func TestReplayFilterMatches(t *testing.T) {
+	failedAt := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	envelope := &DLQEnvelope{
+		OriginalTopic: "orders",
+		Error:         "database is down",
+		FailedAt:      messaging.NewNano3339Time(failedAt),
+	}
+
+	tests := []struct {
+		name   string
+		filter *ReplayFilter
+		want   bool
+	}{
+		{name: "Empty filter", filter: &ReplayFilter{}, want: true},
+		{name: "Matching topic", filter: &ReplayFilter{Topics: []string{"invoices", "orders"}}, want: true},
+		{name: "Other topic", filter: &ReplayFilter{Topics: []string{"invoices"}}, want: false},
+		{name: "Within time range", filter: &ReplayFilter{From: failedAt.Add(-time.Hour), To: failedAt.Add(time.Hour)}, want: true},
+		{name: "Before from", filter: &ReplayFilter{From: failedAt.Add(time.Minute)}, want: false},
+		{name: "After to", filter: &ReplayFilter{To: failedAt.Add(-time.Minute)}, want: false},
+		{name: "Matching error", filter: &ReplayFilter{ErrorContains: "database"}, want: true},
+		{name: "Other error", filter: &ReplayFilter{ErrorContains: "timeout"}, want: false},
+		{name: "Every field must match", filter: &ReplayFilter{Topics: []string{"orders"}, ErrorContains: "timeout"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(envelope); got != tt.want {
+				t.Errorf("TestReplayFilterMatches(): Matches\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures map[string]string
+		filter   *ReplayFilter
+		replayed int
+	}{
+		{name: "Empty dead letter queue", filter: &ReplayFilter{}},
+		{
+			name:     "Matching dead letters are replayed",
+			failures: map[string]string{"orders": "database is down", "invoices": "timeout"},
+			filter:   &ReplayFilter{ErrorContains: "database"},
+			replayed: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer())
+			for topic, failure := range tt.failures {
+				topic := topic
+				msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Key: []byte("42"), Value: []byte("placed")}
+				if err := producer.ProduceMessage(context.Background(), NewDLQMessage(msg, errors.New(failure), 3)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			replayed, err := ReplayDeadLettersFrom(context.Background(), broker.NewConsumer("billing-dlq-reader"), producer, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replayed != tt.replayed {
+				t.Errorf("TestReplayDeadLetters(): ReplayDeadLettersFrom\ngot= \t%v\nwant = \t%v", replayed, tt.replayed)
+			}
+			if sent := len(broker.Messages("orders")); sent != tt.replayed {
+				t.Errorf("TestReplayDeadLetters(): replayed to orders\ngot= \t%v\nwant = \t%v", sent, tt.replayed)
+			}
+			if sent := len(broker.Messages("invoices")); sent != 0 {
+				t.Errorf("TestReplayDeadLetters(): replayed to invoices\ngot= \t%v\nwant = \t%v", sent, 0)
+			}
+		})
+	}
+}
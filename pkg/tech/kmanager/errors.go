@@ -16,3 +16,7 @@ func NewKafkaErrEventParse(message *kafka.Message, topic string, err error) erro
 func NewKafkaErrUnknownTopic(topic string) error {
 	return fmt.Errorf("incoming message is from unknown topic %v", topic)
 }
+
+func NewKafkaErrUnknownEventType(topic, eventType string) error {
+	return fmt.Errorf("incoming event from %v topic has unknown type %v", topic, eventType)
+}
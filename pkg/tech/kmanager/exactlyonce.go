@@ -0,0 +1,171 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/stateful/config"
+	"github.com/Cobalt0s/creme-brulee/pkg/stateful/logging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	// TransactionTimeout bounds initializing, committing and aborting kafka transactions
+	TransactionTimeout = 30 * time.Second
+
+	ErrNotTransactional = errors.New("producer is not transactional")
+	ErrTransformOption  = errors.New("consumer option doesn't apply to transforms")
+)
+
+// NewTransactionalMessageProducer creates an idempotent producer able to run kafka transactions,
+// an empty transactionalID falls back to the one of cfg
+func NewTransactionalMessageProducer(ctx context.Context, cfg *config.KafkaConfig, clientID, transactionalID string, opts ...ProducerOption) (*MessageProducer, error) {
+	configMap, err := cfg.GetKafkaConfigMapTransactionalProducer(clientID, transactionalID)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := kafka.NewProducer(configMap)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransactionalMessageProducerFromClient(ctx, producer, opts...)
+}
+
+// NewTransactionalMessageProducerFromClient initializes transactions of an existing kafka client
+func NewTransactionalMessageProducerFromClient(ctx context.Context, producer KafkaProducer, opts ...ProducerOption) (*MessageProducer, error) {
+	// transactional producers are idempotent
+	p := NewMessageProducerFromClient(producer, append([]ProducerOption{WithOrderedDelivery()}, opts...)...)
+	p.transactional = true
+
+	initCtx, cancel := context.WithTimeout(ctx, TransactionTimeout)
+	defer cancel()
+	if err := producer.InitTransactions(initCtx); err != nil {
+		producer.Close()
+		return nil, fmt.Errorf("failed to init kafka transactions %v", err)
+	}
+	return p, nil
+}
+
+// ProduceTransaction sends messages in a single kafka transaction. When consumer is given, offsets
+// are committed in the same transaction for its group, so they are never committed without the messages.
+func (p *MessageProducer) ProduceTransaction(ctx context.Context, messages []Message, consumer KafkaConsumer, offsets []kafka.TopicPartition) error {
+	if !p.transactional {
+		return ErrNotTransactional
+	}
+	p.txMu.Lock()
+	defer p.txMu.Unlock()
+
+	ctx, span := logging.StartSpan(ctx, "ProduceTransaction")
+	defer span.End()
+
+	if err := p.producer.BeginTransaction(); err != nil {
+		return err
+	}
+	if err := p.transact(ctx, messages, consumer, offsets); err != nil {
+		p.abort(ctx, err)
+		return err
+	}
+	return nil
+}
+
+func (p *MessageProducer) transact(ctx context.Context, messages []Message, consumer KafkaConsumer, offsets []kafka.TopicPartition) error {
+	delivery := make(chan kafka.Event, len(messages))
+	for _, message := range messages {
+		msg, err := p.toKafkaMessage(ctx, message)
+		if err != nil {
+			return err
+		}
+		if err = p.producer.Produce(msg, delivery); err != nil {
+			p.metrics.deliveryFailed(*message.Topic())
+			return err
+		}
+	}
+	for range messages {
+		report := (<-delivery).(*kafka.Message)
+		if err := report.TopicPartition.Error; err != nil {
+			p.metrics.deliveryFailed(*report.TopicPartition.Topic)
+			return err
+		}
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, TransactionTimeout)
+	defer cancel()
+	if consumer != nil && len(offsets) != 0 {
+		group, err := consumer.GetConsumerGroupMetadata()
+		if err != nil {
+			return err
+		}
+		if err = p.producer.SendOffsetsToTransaction(timeoutCtx, offsets, group); err != nil {
+			return err
+		}
+	}
+	return p.producer.CommitTransaction(timeoutCtx)
+}
+
+func (p *MessageProducer) abort(ctx context.Context, cause error) {
+	log := ctxlogrus.Extract(ctx)
+
+	if kErr, ok := cause.(kafka.Error); ok && kErr.IsFatal() {
+		// the producer is fenced or broken, it can't run further transactions
+		log.Errorf("fatal kafka transaction error %v", cause)
+		return
+	}
+	abortCtx, cancel := context.WithTimeout(ctx, TransactionTimeout)
+	defer cancel()
+	if err := p.producer.AbortTransaction(abortCtx); err != nil {
+		log.Errorf("failed to abort kafka transaction %v", err)
+	}
+}
+
+// TransformHandler turns a consumed message into the messages to produce for it
+type TransformHandler func(ctx context.Context, arguments *messaging.ContextualArguments,
+	db *gorm.DB, msg *kafka.Message) ([]Message, error)
+
+// Transform produces the output of handler in a transaction of producer which also commits the
+// offset of the consumed message, so each message is transformed exactly once. Failures follow
+// the retry policy and end up in the DLQ as with any other handler.
+// Each transaction commits the offset right after its message, so messages must be transformed
+// one at a time in offset order, see StartTransform.
+func (mc *MessageConsumer) Transform(producer *MessageProducer, handler TransformHandler) TopicHandler {
+	return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		output, err := handler(ctx, arguments, db, msg)
+		if err != nil {
+			return err
+		}
+		// the offset of a retried message belongs to the retry topic it was read from
+		tp := consumedPartition(msg)
+		tp.Offset++
+		if err = producer.ProduceTransaction(ctx, output, mc.consumer, []kafka.TopicPartition{tp}); err != nil {
+			return err
+		}
+		if committed, ok := ctx.Value(transactionCommitKey{}).(*bool); ok {
+			*committed = true
+		}
+		return nil
+	}
+}
+
+type transactionCommitKey struct{}
+
+// withTransactionCommit lets Transform report that the offset of the message was committed
+// by its transaction, so the consumer doesn't commit it again
+func withTransactionCommit(ctx context.Context) (context.Context, *bool) {
+	committed := false
+	return context.WithValue(ctx, transactionCommitKey{}, &committed), &committed
+}
+
+// StartTransform consumes messages through Transform. WithConcurrency is rejected with ErrTransformOption,
+// a worker committing the offset of a later message would skip earlier ones still in flight.
+func (mc *MessageConsumer) StartTransform(ctx context.Context, producer *MessageProducer, handler TransformHandler) error {
+	if !producer.transactional {
+		return ErrNotTransactional
+	}
+	if mc.workers > 1 {
+		return fmt.Errorf("%w: WithConcurrency", ErrTransformOption)
+	}
+	return mc.Start(ctx, mc.Transform(producer, handler))
+}
@@ -0,0 +1,114 @@
+package kmanager
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var DefaultHealthCheckTimeout = 5 * time.Second
+
+// KafkaHealthChecker reports a consumer as unhealthy when brokers are unreachable
+// or when the lag of an assigned partition exceeds maxLag, zero disables the lag check
+type KafkaHealthChecker struct {
+	consumer KafkaConsumer
+	maxLag   int64
+}
+
+func NewKafkaHealthChecker(mc *MessageConsumer, maxLag int64) *KafkaHealthChecker {
+	return &KafkaHealthChecker{
+		consumer: mc.consumer,
+		maxLag:   maxLag,
+	}
+}
+
+func (h *KafkaHealthChecker) Name() string {
+	return "kafka-consumer"
+}
+
+func (h *KafkaHealthChecker) Check(ctx context.Context) error {
+	timeout, err := timeoutMs(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = h.consumer.GetMetadata(nil, false, timeout); err != nil {
+		return fmt.Errorf("brokers unreachable: %v", err)
+	}
+
+	assignment, err := h.consumer.Assignment()
+	if err != nil {
+		return fmt.Errorf("couldn't read assignment: %v", err)
+	}
+	if h.maxLag <= 0 || len(assignment) == 0 {
+		return nil
+	}
+
+	if timeout, err = timeoutMs(ctx); err != nil {
+		return err
+	}
+	committed, err := h.consumer.Committed(assignment, timeout)
+	if err != nil {
+		return fmt.Errorf("couldn't read committed offsets: %v", err)
+	}
+	for _, tp := range committed {
+		low, high, err := h.consumer.GetWatermarkOffsets(*tp.Topic, tp.Partition)
+		if err != nil {
+			return fmt.Errorf("couldn't read watermarks of %v: %v", partitionKey(tp), err)
+		}
+		offset := int64(tp.Offset)
+		if offset < 0 {
+			// nothing committed yet
+			offset = low
+		}
+		if lag := high - offset; lag > h.maxLag {
+			return fmt.Errorf("partition %v lags %v messages behind", partitionKey(tp), lag)
+		}
+	}
+	return nil
+}
+
+type KafkaProducerHealthChecker struct {
+	producer KafkaProducer
+}
+
+func NewKafkaProducerHealthChecker(p *MessageProducer) *KafkaProducerHealthChecker {
+	return &KafkaProducerHealthChecker{producer: p.producer}
+}
+
+func (h *KafkaProducerHealthChecker) Name() string {
+	return "kafka-producer"
+}
+
+func (h *KafkaProducerHealthChecker) Check(ctx context.Context) error {
+	if err := h.producer.GetFatalError(); err != nil {
+		return err
+	}
+	timeout, err := timeoutMs(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err = h.producer.GetMetadata(nil, false, timeout); err != nil {
+		return fmt.Errorf("brokers unreachable: %v", err)
+	}
+	return nil
+}
+
+// timeoutMs is what remains of the deadline of ctx for the next kafka call, kafka
+// reads zero as don't wait and negative values as wait forever so it is at least 1ms
+func timeoutMs(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return int(DefaultHealthCheckTimeout.Milliseconds()), nil
+	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	if remaining < time.Millisecond {
+		return 1, nil
+	}
+	return int(remaining.Milliseconds()), nil
+}
@@ -0,0 +1,82 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"testing"
+	"time"
+)
+
+func TestKafkaHealthChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxLag  int64
+		healthy bool
+	}{
+		{name: "Lag check disabled", maxLag: 0, healthy: true},
+		{name: "Lag below the maximum", maxLag: 5, healthy: true},
+		{name: "Lag above the maximum", maxLag: 2, healthy: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer())
+			for i := 0; i < 3; i++ {
+				if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			consumer := broker.NewConsumer("billing")
+			if err := consumer.SubscribeTopics([]string{"orders"}, nil); err != nil {
+				t.Fatal(err)
+			}
+			// reading joins the group, nothing is committed so all messages lag behind
+			if _, err := consumer.ReadMessage(time.Second); err != nil {
+				t.Fatal(err)
+			}
+			mc := NewMessageConsumerFromClients(nil, nil, consumer, producer, "billing", []string{"orders"})
+
+			err := NewKafkaHealthChecker(mc, tt.maxLag).Check(context.Background())
+			if (err == nil) != tt.healthy {
+				t.Errorf("TestKafkaHealthChecker(): Check\ngot= \t%v\nwant = \t%v", err, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestKafkaProducerHealthChecker(t *testing.T) {
+	producer := NewMessageProducerFromClient(kafkatest.NewBroker().NewProducer())
+	if err := NewKafkaProducerHealthChecker(producer).Check(context.Background()); err != nil {
+		t.Errorf("TestKafkaProducerHealthChecker(): Check\ngot= \t%v\nwant = \t%v", err, nil)
+	}
+}
+
+func TestTimeoutMs(t *testing.T) {
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	ahead, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		timeout int
+		err     error
+	}{
+		{name: "Deadline ahead", ctx: ahead, timeout: int(time.Minute.Milliseconds())},
+		{name: "No deadline", ctx: context.Background(), timeout: int(DefaultHealthCheckTimeout.Milliseconds())},
+		{name: "Deadline passed", ctx: expired, err: context.DeadlineExceeded},
+		{name: "Cancelled", ctx: cancelled, err: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout, err := timeoutMs(tt.ctx)
+			// the remaining time shrinks a little before it is read
+			if err != tt.err || (err == nil && (timeout > tt.timeout || timeout < tt.timeout-1000)) {
+				t.Errorf("TestTimeoutMs(): timeoutMs\ngot= \t%v %v\nwant = \t%v %v", timeout, err, tt.timeout, tt.err)
+			}
+		})
+	}
+}
@@ -2,45 +2,83 @@ package kmanager
 
 import (
 	"context"
-	"fmt"
 	config2 "github.com/Cobalt0s/creme-brulee/pkg/stateful/config"
-	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"sort"
 )
 
 var (
 	DefaultTopics = []string{DeadLetterQueueTopic}
-)
 
-func CreateTopics(ctx context.Context, baseConf *config2.BaseConfig, cfg *config2.KafkaConfig, topicNames []string) {
-	log := ctxlogrus.Extract(ctx)
+	adminClientID = "kmanager-admin"
+)
 
+// CreateTopics creates topicNames along with their retry tier topics, if any, with a single
+// partition in the testing environment. Other environments declare their topics with EnsureTopics.
+func CreateTopics(ctx context.Context, baseConf *config2.BaseConfig, cfg *config2.KafkaConfig, topicNames []string, retryTiers ...RetryTier) error {
 	if baseConf.Env != "testing" {
-		return
+		return nil
 	}
 
-	ka, err := kafka.NewAdminClient(&kafka.ConfigMap{
-		"bootstrap.servers": cfg.Host,
-	})
+	admin, err := NewTopicAdmin(cfg, adminClientID)
 	if err != nil {
-		log.Fatal(fmt.Errorf("failed to init kafka admin client %v", err))
+		return err
 	}
+	defer admin.Close()
 
-	topicNames = addDefaultTopics(topicNames)
-
-	topics := make([]kafka.TopicSpecification, len(topicNames))
+	topicNames = addDefaultTopics(append(RetryTopicNames(topicNames, retryTiers), topicNames...))
+	specs := make([]TopicSpec, len(topicNames))
 	for i, name := range topicNames {
-		topics[i] = kafka.TopicSpecification{
-			Topic:             name,
-			NumPartitions:     1,
-			ReplicationFactor: 1,
-		}
+		specs[i] = TopicSpec{Name: name}
 	}
 
-	_, err = ka.CreateTopics(ctx, topics)
+	_, err = admin.Reconcile(ctx, specs, false)
+	return err
+}
+
+// EnsureTopics creates or reconciles specs in any environment, along with the retry tier topics
+// of each spec, which share its partitions, replication and configs, and DefaultTopics.
+// The drift found is returned, see TopicAdmin.Reconcile.
+func EnsureTopics(ctx context.Context, cfg *config2.KafkaConfig, specs []TopicSpec, retryTiers ...RetryTier) ([]TopicDrift, error) {
+	admin, err := NewTopicAdmin(cfg, adminClientID)
 	if err != nil {
-		log.Fatal(fmt.Errorf("failed to auto create topics %v", err))
+		return nil, err
+	}
+	defer admin.Close()
+	return admin.Reconcile(ctx, withDefaultSpecs(specs, retryTiers), false)
+}
+
+// withDefaultSpecs adds the retry tier topics of specs and DefaultTopics which aren't declared,
+// DefaultTopics aren't retried so they get no tier topics
+func withDefaultSpecs(specs []TopicSpec, retryTiers []RetryTier) []TopicSpec {
+	defaults := map[string]bool{}
+	for _, name := range DefaultTopics {
+		defaults[name] = true
+	}
+	declared := map[string]bool{}
+	var result []TopicSpec
+	add := func(spec TopicSpec) {
+		if !declared[spec.Name] {
+			declared[spec.Name] = true
+			result = append(result, spec)
+		}
+	}
+	for _, spec := range specs {
+		add(spec)
+	}
+	for _, spec := range specs {
+		if defaults[spec.Name] {
+			continue
+		}
+		for _, tier := range retryTiers {
+			retrySpec := spec
+			retrySpec.Name = tier.TopicFor(spec.Name)
+			add(retrySpec)
+		}
+	}
+	for _, name := range DefaultTopics {
+		add(TopicSpec{Name: name})
 	}
+	return result
 }
 
 func addDefaultTopics(topicNames []string) []string {
@@ -53,11 +91,10 @@ func addDefaultTopics(topicNames []string) []string {
 		uniqueTopics[name] = true
 	}
 	// map to slice conversion
-	result := make([]string, len(uniqueTopics))
-	index := 0
+	result := make([]string, 0, len(uniqueTopics))
 	for topic := range uniqueTopics {
-		result[index] = topic
-		index += 1
+		result = append(result, topic)
 	}
-	return topicNames
+	sort.Strings(result)
+	return result
 }
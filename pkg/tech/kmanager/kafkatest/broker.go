@@ -0,0 +1,252 @@
+// Package kafkatest provides an in memory kafka broker whose consumers and producers implement
+// kmanager.KafkaConsumer and kmanager.KafkaProducer, so consumers can be tested without a network.
+package kafkatest
+
+import (
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultPartitions is the partition count of topics created on first produce
+	DefaultPartitions = 1
+	// PollWait caps how long ReadMessage blocks, so stopped consumer loops notice it quickly
+	PollWait = 10 * time.Millisecond
+)
+
+// Broker keeps topics, offsets committed by consumer groups and transactions in memory.
+// Partitions are spread over the members of a group, see group.
+type Broker struct {
+	mu        sync.Mutex
+	topics    map[string][][]*kafka.Message
+	committed map[string]map[string]kafka.Offset
+	groups    map[string]*group
+	// members tells the group of consumer group metadata handed to transactions
+	members  map[*kafka.ConsumerGroupMetadata]string
+	failures map[string]error
+	// changed is closed and replaced whenever messages are appended or a group changes
+	changed chan struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		topics:    map[string][][]*kafka.Message{},
+		committed: map[string]map[string]kafka.Offset{},
+		groups:    map[string]*group{},
+		members:   map[*kafka.ConsumerGroupMetadata]string{},
+		failures:  map[string]error{},
+		changed:   make(chan struct{}),
+	}
+}
+
+// CreateTopic creates the topic or adds partitions up to the given count
+func (b *Broker) CreateTopic(topic string, partitions int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.topics[topic]) < partitions {
+		b.topics[topic] = append(b.topics[topic], nil)
+	}
+}
+
+// FailProduce makes deliveries to topic fail with err, nil lets them succeed again
+func (b *Broker) FailProduce(topic string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		delete(b.failures, topic)
+		return
+	}
+	b.failures[topic] = err
+}
+
+// Messages returns what was written to topic, partition by partition
+func (b *Broker) Messages(topic string) []*kafka.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var result []*kafka.Message
+	for _, log := range b.topics[topic] {
+		for _, msg := range log {
+			result = append(result, copyMessage(msg))
+		}
+	}
+	return result
+}
+
+// Committed returns the offset committed by group, kafka.OffsetInvalid when there is none
+func (b *Broker) Committed(group, topic string, partition int32) kafka.Offset {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.committedLocked(group, kafka.TopicPartition{Topic: &topic, Partition: partition})
+}
+
+func (b *Broker) NewConsumer(group string) *Consumer {
+	meta := &kafka.ConsumerGroupMetadata{}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.members[meta] = group
+	return &Consumer{
+		broker:   b,
+		group:    group,
+		meta:     meta,
+		assigned: map[string]*assignment{},
+	}
+}
+
+func (b *Broker) NewProducer() *Producer {
+	return &Producer{broker: b, events: make(chan kafka.Event, 1024), done: make(chan struct{})}
+}
+
+// append writes msg to its partition, picking one by key hash for kafka.PartitionAny
+func (b *Broker) append(msg *kafka.Message) (*kafka.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tp, err := b.partitionLocked(msg)
+	if err != nil {
+		return nil, err
+	}
+	written := b.appendLocked(msg, tp)
+	b.notifyLocked()
+	return copyMessage(written), nil
+}
+
+// commitTransaction writes msgs and commits the offsets of each group at once,
+// nothing is written when any of the messages can't be
+func (b *Broker) commitTransaction(msgs []*kafka.Message, offsets map[string][]kafka.TopicPartition) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	partitions := make([]kafka.TopicPartition, len(msgs))
+	for i, msg := range msgs {
+		tp, err := b.partitionLocked(msg)
+		if err != nil {
+			return err
+		}
+		partitions[i] = tp
+	}
+	for i, msg := range msgs {
+		b.appendLocked(msg, partitions[i])
+	}
+	for group, groupOffsets := range offsets {
+		b.commitLocked(group, groupOffsets)
+	}
+	b.notifyLocked()
+	return nil
+}
+
+func (b *Broker) appendLocked(msg *kafka.Message, tp kafka.TopicPartition) *kafka.Message {
+	log := b.topics[*tp.Topic][tp.Partition]
+	tp.Offset = kafka.Offset(len(log))
+
+	written := copyMessage(msg)
+	written.TopicPartition = tp
+	written.Timestamp = time.Now()
+	written.TimestampType = kafka.TimestampCreateTime
+	b.topics[*tp.Topic][tp.Partition] = append(log, written)
+	return written
+}
+
+// notifyLocked wakes up consumers waiting for messages or rebalances
+func (b *Broker) notifyLocked() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// partitionLocked validates the target of msg, creating its topic when needed
+func (b *Broker) partitionLocked(msg *kafka.Message) (kafka.TopicPartition, error) {
+	if msg.TopicPartition.Topic == nil {
+		return kafka.TopicPartition{}, kafka.NewError(kafka.ErrInvalidArg, "message has no topic", false)
+	}
+	topic := *msg.TopicPartition.Topic
+	if err, ok := b.failures[topic]; ok {
+		return kafka.TopicPartition{}, err
+	}
+	if len(b.topics[topic]) == 0 {
+		b.topics[topic] = make([][]*kafka.Message, DefaultPartitions)
+	}
+
+	partition := msg.TopicPartition.Partition
+	if partition == kafka.PartitionAny {
+		hash := fnv.New32a()
+		_, _ = hash.Write(msg.Key)
+		partition = int32(hash.Sum32() % uint32(len(b.topics[topic])))
+	}
+	if partition < 0 || int(partition) >= len(b.topics[topic]) {
+		return kafka.TopicPartition{}, kafka.NewError(kafka.ErrUnknownTopicOrPart, fmt.Sprintf("%v has no partition %v", topic, partition), false)
+	}
+	return kafka.TopicPartition{Topic: &topic, Partition: partition}, nil
+}
+
+func (b *Broker) commitLocked(group string, offsets []kafka.TopicPartition) {
+	committed, ok := b.committed[group]
+	if !ok {
+		committed = map[string]kafka.Offset{}
+		b.committed[group] = committed
+	}
+	for _, tp := range offsets {
+		committed[partitionKey(tp)] = tp.Offset
+	}
+}
+
+func (b *Broker) committedLocked(group string, tp kafka.TopicPartition) kafka.Offset {
+	if offset, ok := b.committed[group][partitionKey(tp)]; ok {
+		return offset
+	}
+	return kafka.OffsetInvalid
+}
+
+func (b *Broker) metadata() *kafka.Metadata {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	broker := kafka.BrokerMetadata{ID: 1, Host: "in-memory", Port: 9092}
+	metadata := &kafka.Metadata{
+		Brokers:           []kafka.BrokerMetadata{broker},
+		Topics:            map[string]kafka.TopicMetadata{},
+		OriginatingBroker: broker,
+	}
+	for topic, partitions := range b.topics {
+		topicMetadata := kafka.TopicMetadata{Topic: topic}
+		for i := range partitions {
+			topicMetadata.Partitions = append(topicMetadata.Partitions, kafka.PartitionMetadata{
+				ID:       int32(i),
+				Leader:   broker.ID,
+				Replicas: []int32{broker.ID},
+				Isrs:     []int32{broker.ID},
+			})
+		}
+		metadata.Topics[topic] = topicMetadata
+	}
+	return metadata
+}
+
+func copyMessage(msg *kafka.Message) *kafka.Message {
+	result := *msg
+	result.Key = append([]byte(nil), msg.Key...)
+	result.Value = append([]byte(nil), msg.Value...)
+	result.Headers = append([]kafka.Header(nil), msg.Headers...)
+	return &result
+}
+
+func partitionKey(tp kafka.TopicPartition) string {
+	topic := ""
+	if tp.Topic != nil {
+		topic = *tp.Topic
+	}
+	return fmt.Sprintf("%v/%v", topic, tp.Partition)
+}
+
+func sortPartitions(partitions []kafka.TopicPartition) {
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitionKey(partitions[i]) < partitionKey(partitions[j])
+	})
+}
@@ -0,0 +1,172 @@
+package kafkatest
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type rebalanceLog struct {
+	events []string
+}
+
+func (l *rebalanceLog) callback(_ *kafka.Consumer, event kafka.Event) error {
+	switch e := event.(type) {
+	case kafka.AssignedPartitions:
+		l.events = append(l.events, "assigned "+formatPartitions(e.Partitions))
+	case kafka.RevokedPartitions:
+		l.events = append(l.events, "revoked "+formatPartitions(e.Partitions))
+	}
+	return nil
+}
+
+func formatPartitions(partitions []kafka.TopicPartition) string {
+	result := ""
+	for _, tp := range partitions {
+		result += partitionKey(tp) + " "
+	}
+	return result
+}
+
+func TestGroupRebalance(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("orders", 2)
+
+	first, second := &rebalanceLog{}, &rebalanceLog{}
+	c1, c2 := broker.NewConsumer("billing"), broker.NewConsumer("billing")
+	if err := c1.SubscribeTopics([]string{"orders"}, first.callback); err != nil {
+		t.Fatal(err)
+	}
+	readOnce(c1)
+
+	if err := c2.SubscribeTopics([]string{"orders"}, second.callback); err != nil {
+		t.Fatal(err)
+	}
+	// the second member waits until the first one released its partition
+	readOnce(c2)
+	readOnce(c1)
+	readOnce(c2)
+	assertAssignment(t, c1, "orders/0 ")
+	assertAssignment(t, c2, "orders/1 ")
+
+	if err := c2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	readOnce(c1)
+	assertAssignment(t, c1, "orders/0 orders/1 ")
+
+	wantFirst := []string{"assigned orders/0 orders/1 ", "revoked orders/1 ", "assigned orders/1 "}
+	if !reflect.DeepEqual(first.events, wantFirst) {
+		t.Errorf("TestGroupRebalance(): first member\ngot= \t%v\nwant = \t%v", first.events, wantFirst)
+	}
+	wantSecond := []string{"assigned orders/1 ", "revoked orders/1 "}
+	if !reflect.DeepEqual(second.events, wantSecond) {
+		t.Errorf("TestGroupRebalance(): second member\ngot= \t%v\nwant = \t%v", second.events, wantSecond)
+	}
+}
+
+func TestGroupMembersShareMessages(t *testing.T) {
+	broker := NewBroker()
+	broker.CreateTopic("orders", 2)
+	producer := broker.NewProducer()
+	orders := "orders"
+	for partition := int32(0); partition < 2; partition++ {
+		msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: partition}, Key: []byte("42")}
+		if err := producer.Produce(msg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c1, c2 := broker.NewConsumer("billing"), broker.NewConsumer("billing")
+	for _, c := range []*Consumer{c1, c2} {
+		if err := c.SubscribeTopics([]string{"orders"}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := map[string]int{}
+	deadline := time.Now().Add(time.Second)
+	for len(read) < 2 && time.Now().Before(deadline) {
+		for name, c := range map[string]*Consumer{"c1": c1, "c2": c2} {
+			if msg, err := c.ReadMessage(time.Millisecond); err == nil {
+				read[name+" "+partitionKey(msg.TopicPartition)]++
+			}
+		}
+	}
+
+	want := map[string]int{"c1 orders/0": 1, "c2 orders/1": 1}
+	if !reflect.DeepEqual(read, want) {
+		t.Errorf("TestGroupMembersShareMessages(): messages read\ngot= \t%v\nwant = \t%v", read, want)
+	}
+}
+
+func TestCommitTransaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      bool
+		messages  int
+		committed kafka.Offset
+	}{
+		{name: "Messages and offsets become visible together", messages: 2, committed: 1},
+		{name: "Nothing becomes visible when a message can't be written", fail: true, committed: kafka.OffsetInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := NewBroker()
+			consumer := broker.NewConsumer("billing")
+			producer := broker.NewProducer()
+			ctx := context.Background()
+			if err := producer.InitTransactions(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := producer.BeginTransaction(); err != nil {
+				t.Fatal(err)
+			}
+
+			receipts, invoices, orders := "receipts", "invoices", "orders"
+			for _, topic := range []*string{&receipts, &invoices} {
+				msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: topic, Partition: kafka.PartitionAny}, Key: []byte("42")}
+				if err := producer.Produce(msg, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			meta, _ := consumer.GetConsumerGroupMetadata()
+			offsets := []kafka.TopicPartition{{Topic: &orders, Partition: 0, Offset: 1}}
+			if err := producer.SendOffsetsToTransaction(ctx, offsets, meta); err != nil {
+				t.Fatal(err)
+			}
+			if tt.fail {
+				broker.FailProduce(invoices, kafka.NewError(kafka.ErrMsgSizeTooLarge, "too large", false))
+			}
+
+			if err := producer.CommitTransaction(ctx); (err != nil) != tt.fail {
+				t.Fatalf("TestCommitTransaction(): error\ngot= \t%v\nwant = \t%v", err, tt.fail)
+			}
+			if messages := len(broker.Messages(receipts)) + len(broker.Messages(invoices)); messages != tt.messages {
+				t.Errorf("TestCommitTransaction(): messages\ngot= \t%v\nwant = \t%v", messages, tt.messages)
+			}
+			if offset := broker.Committed("billing", orders, 0); offset != tt.committed {
+				t.Errorf("TestCommitTransaction(): offset\ngot= \t%v\nwant = \t%v", offset, tt.committed)
+			}
+			if err := producer.BeginTransaction(); err != nil {
+				t.Errorf("TestCommitTransaction(): transaction still open %v", err)
+			}
+		})
+	}
+}
+
+func readOnce(c *Consumer) {
+	_, _ = c.ReadMessage(time.Millisecond)
+}
+
+func assertAssignment(t *testing.T, c *Consumer, want string) {
+	t.Helper()
+	assignment, err := c.Assignment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatPartitions(assignment); got != want {
+		t.Errorf("Assignment()\ngot= \t%v\nwant = \t%v", got, want)
+	}
+}
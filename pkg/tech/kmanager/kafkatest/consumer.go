@@ -0,0 +1,335 @@
+package kafkatest
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"sync"
+	"time"
+)
+
+// Consumer reads the partitions its group assigns to it, starting at the offsets committed
+// by the group or at the beginning of partitions the group hasn't committed yet.
+// Like the kafka client, the rebalance callback is called from ReadMessage and Close.
+type Consumer struct {
+	broker *Broker
+	group  string
+	meta   *kafka.ConsumerGroupMetadata
+
+	mu          sync.Mutex
+	subscribed  bool
+	rebalanceCb kafka.RebalanceCb
+	assigned    map[string]*assignment
+	order       []string
+	next        int
+	closed      bool
+}
+
+type assignment struct {
+	partition kafka.TopicPartition
+	position  kafka.Offset
+	paused    bool
+}
+
+func (c *Consumer) SubscribeTopics(topics []string, rebalanceCb kafka.RebalanceCb) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed()
+	}
+
+	c.subscribed = true
+	c.rebalanceCb = rebalanceCb
+	c.broker.join(c, topics)
+	return nil
+}
+
+// ReadMessage returns the next message of an assigned partition which isn't paused,
+// it times out after at most PollWait
+func (c *Consumer) ReadMessage(timeout time.Duration) (*kafka.Message, error) {
+	if timeout > PollWait || timeout < 0 {
+		timeout = PollWait
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		c.broker.mu.Lock()
+		changed := c.broker.changed
+		c.broker.mu.Unlock()
+
+		if err := c.rebalance(); err != nil {
+			return nil, err
+		}
+		if msg := c.poll(); msg != nil {
+			return msg, nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return nil, kafka.NewError(kafka.ErrTimedOut, "no message before the timeout", false)
+		}
+	}
+}
+
+// rebalance hands partitions due to other members of the group over to them
+// and takes over the ones due to c once they were released
+func (c *Consumer) rebalance() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errClosed()
+	}
+	if !c.subscribed {
+		c.mu.Unlock()
+		return nil
+	}
+	revoked := c.broker.surplus(c, c.assignmentLocked())
+	rebalanceCb := c.rebalanceCb
+	c.mu.Unlock()
+
+	var err error
+	if len(revoked) != 0 {
+		if rebalanceCb != nil {
+			err = rebalanceCb(nil, kafka.RevokedPartitions{Partitions: revoked})
+		}
+		c.mu.Lock()
+		c.unassignLocked(revoked)
+		c.mu.Unlock()
+		c.broker.release(c, revoked)
+	}
+
+	c.mu.Lock()
+	acquired := c.broker.acquire(c)
+	added := make([]kafka.TopicPartition, len(acquired))
+	for i, a := range acquired {
+		key := partitionKey(a.partition)
+		c.assigned[key] = a
+		c.order = append(c.order, key)
+		added[i] = a.partition
+	}
+	c.mu.Unlock()
+
+	if len(added) != 0 && rebalanceCb != nil {
+		sortPartitions(added)
+		if cbErr := rebalanceCb(nil, kafka.AssignedPartitions{Partitions: added}); err == nil {
+			err = cbErr
+		}
+	}
+	return err
+}
+
+func (c *Consumer) assignmentLocked() []kafka.TopicPartition {
+	result := make([]kafka.TopicPartition, 0, len(c.assigned))
+	for _, a := range c.assigned {
+		result = append(result, a.partition)
+	}
+	sortPartitions(result)
+	return result
+}
+
+func (c *Consumer) unassignLocked(partitions []kafka.TopicPartition) {
+	for _, tp := range partitions {
+		delete(c.assigned, partitionKey(tp))
+	}
+	order := c.order[:0]
+	for _, key := range c.order {
+		if _, ok := c.assigned[key]; ok {
+			order = append(order, key)
+		}
+	}
+	c.order = order
+	c.next = 0
+}
+
+// poll goes round robin over the assigned partitions
+func (c *Consumer) poll() *kafka.Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	for i := 0; i < len(c.order); i++ {
+		key := c.order[(c.next+i)%len(c.order)]
+		a := c.assigned[key]
+		log := c.broker.topics[*a.partition.Topic][a.partition.Partition]
+		if a.paused || int(a.position) >= len(log) {
+			continue
+		}
+		msg := copyMessage(log[a.position])
+		a.position++
+		c.next = (c.next + i + 1) % len(c.order)
+		return msg
+	}
+	return nil
+}
+
+func (c *Consumer) CommitMessage(msg *kafka.Message) ([]kafka.TopicPartition, error) {
+	tp := msg.TopicPartition
+	tp.Offset++
+	return c.CommitOffsets([]kafka.TopicPartition{tp})
+}
+
+func (c *Consumer) CommitOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	c.broker.commitLocked(c.group, offsets)
+	return offsets, nil
+}
+
+func (c *Consumer) Committed(partitions []kafka.TopicPartition, _ int) ([]kafka.TopicPartition, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	result := make([]kafka.TopicPartition, len(partitions))
+	for i, tp := range partitions {
+		result[i] = tp
+		result[i].Offset = c.broker.committedLocked(c.group, tp)
+	}
+	return result, nil
+}
+
+func (c *Consumer) Assignment() ([]kafka.TopicPartition, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.assignmentLocked(), nil
+}
+
+func (c *Consumer) AssignmentLost() bool {
+	return false
+}
+
+func (c *Consumer) Pause(partitions []kafka.TopicPartition) error {
+	return c.setPaused(partitions, true)
+}
+
+func (c *Consumer) Resume(partitions []kafka.TopicPartition) error {
+	return c.setPaused(partitions, false)
+}
+
+func (c *Consumer) setPaused(partitions []kafka.TopicPartition, paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, tp := range partitions {
+		if a, ok := c.assigned[partitionKey(tp)]; ok {
+			a.paused = paused
+		}
+	}
+	return nil
+}
+
+func (c *Consumer) Seek(partition kafka.TopicPartition, _ int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a, ok := c.assigned[partitionKey(partition)]
+	if !ok {
+		return kafka.NewError(kafka.ErrState, "partition is not assigned", false)
+	}
+	switch partition.Offset {
+	case kafka.OffsetBeginning:
+		a.position = 0
+	case kafka.OffsetEnd:
+		c.broker.mu.Lock()
+		a.position = kafka.Offset(len(c.broker.topics[*partition.Topic][partition.Partition]))
+		c.broker.mu.Unlock()
+	default:
+		a.position = partition.Offset
+	}
+	return nil
+}
+
+// Assign replaces the assignment of a consumer which isn't subscribed to topics. Partitions are
+// read from their offset, or from the offset committed by the group when they have none.
+func (c *Consumer) Assign(partitions []kafka.TopicPartition) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed()
+	}
+	if c.subscribed {
+		return kafka.NewError(kafka.ErrState, "consumer is subscribed to topics", false)
+	}
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	assigned := map[string]*assignment{}
+	order := make([]string, 0, len(partitions))
+	for _, tp := range partitions {
+		logs := c.broker.topics[*tp.Topic]
+		if int(tp.Partition) >= len(logs) {
+			return kafka.NewError(kafka.ErrUnknownTopicOrPart, "unknown partition", false)
+		}
+		position := tp.Offset
+		switch {
+		case tp.Offset == kafka.OffsetBeginning:
+			position = 0
+		case tp.Offset == kafka.OffsetEnd:
+			position = kafka.Offset(len(logs[tp.Partition]))
+		case tp.Offset < 0:
+			if position = c.broker.committedLocked(c.group, tp); position < 0 {
+				position = 0
+			}
+		}
+		tp.Offset = kafka.OffsetInvalid
+		key := partitionKey(tp)
+		assigned[key] = &assignment{partition: tp, position: position}
+		order = append(order, key)
+	}
+	c.assigned = assigned
+	c.order = order
+	c.next = 0
+	return nil
+}
+
+// QueryWatermarkOffsets returns the same offsets as GetWatermarkOffsets, the broker being local
+func (c *Consumer) QueryWatermarkOffsets(topic string, partition int32, _ int) (int64, int64, error) {
+	return c.GetWatermarkOffsets(topic, partition)
+}
+
+func (c *Consumer) GetWatermarkOffsets(topic string, partition int32) (int64, int64, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	partitions := c.broker.topics[topic]
+	if int(partition) >= len(partitions) {
+		return 0, 0, kafka.NewError(kafka.ErrUnknownTopicOrPart, "unknown partition", false)
+	}
+	return 0, int64(len(partitions[partition])), nil
+}
+
+func (c *Consumer) GetMetadata(_ *string, _ bool, _ int) (*kafka.Metadata, error) {
+	return c.broker.metadata(), nil
+}
+
+func (c *Consumer) GetConsumerGroupMetadata() (*kafka.ConsumerGroupMetadata, error) {
+	return c.meta, nil
+}
+
+// Close revokes the assigned partitions through the rebalance callback and leaves the group
+func (c *Consumer) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errClosed()
+	}
+	c.closed = true
+	revoked := c.assignmentLocked()
+	c.assigned = map[string]*assignment{}
+	c.order = nil
+	rebalanceCb := c.rebalanceCb
+	c.mu.Unlock()
+
+	var err error
+	if len(revoked) != 0 && rebalanceCb != nil {
+		err = rebalanceCb(nil, kafka.RevokedPartitions{Partitions: revoked})
+	}
+	c.broker.leave(c)
+	return err
+}
+
+func errClosed() error {
+	return kafka.NewError(kafka.ErrState, "client is closed", false)
+}
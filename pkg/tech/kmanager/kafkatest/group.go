@@ -0,0 +1,146 @@
+package kafkatest
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// group spreads the partitions of each topic over the members subscribed to it, taking turns
+// in the order they joined. A partition is handed to its next owner only once the previous
+// one released it, so two members never read it at the same time.
+type group struct {
+	members       []*Consumer
+	subscriptions map[*Consumer][]string
+	owners        map[string]*Consumer
+}
+
+func (b *Broker) groupLocked(name string) *group {
+	g, ok := b.groups[name]
+	if !ok {
+		g = &group{
+			subscriptions: map[*Consumer][]string{},
+			owners:        map[string]*Consumer{},
+		}
+		b.groups[name] = g
+	}
+	return g
+}
+
+// join subscribes c to topics, making it a member of its group when it isn't one yet
+func (b *Broker) join(c *Consumer, topics []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.groupLocked(c.group)
+	if _, ok := g.subscriptions[c]; !ok {
+		g.members = append(g.members, c)
+	}
+	g.subscriptions[c] = append([]string(nil), topics...)
+	b.notifyLocked()
+}
+
+// leave removes c from its group, the partitions it owned go to the remaining members
+func (b *Broker) leave(c *Consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.groupLocked(c.group)
+	delete(g.subscriptions, c)
+	for i, member := range g.members {
+		if member == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	for key, owner := range g.owners {
+		if owner == c {
+			delete(g.owners, key)
+		}
+	}
+	b.notifyLocked()
+}
+
+// surplus returns the partitions among owned which are due to other members
+func (b *Broker) surplus(c *Consumer, owned []kafka.TopicPartition) []kafka.TopicPartition {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	desired := b.desiredLocked(c)
+	var result []kafka.TopicPartition
+	for _, tp := range owned {
+		if _, ok := desired[partitionKey(tp)]; !ok {
+			result = append(result, tp)
+		}
+	}
+	return result
+}
+
+// release gives up partitions owned by c
+func (b *Broker) release(c *Consumer, partitions []kafka.TopicPartition) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.groupLocked(c.group)
+	for _, tp := range partitions {
+		if g.owners[partitionKey(tp)] == c {
+			delete(g.owners, partitionKey(tp))
+		}
+	}
+	b.notifyLocked()
+}
+
+// acquire makes c the owner of the partitions due to it which no other member owns,
+// they are returned positioned at the offsets committed by the group
+func (b *Broker) acquire(c *Consumer) []*assignment {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g := b.groupLocked(c.group)
+	var result []*assignment
+	for key, tp := range b.desiredLocked(c) {
+		if _, owned := g.owners[key]; owned {
+			continue
+		}
+		g.owners[key] = c
+		position := b.committedLocked(c.group, tp)
+		if position < 0 {
+			position = 0
+		}
+		result = append(result, &assignment{partition: tp, position: position})
+	}
+	return result
+}
+
+// desiredLocked lists the partitions due to c
+func (b *Broker) desiredLocked(c *Consumer) map[string]kafka.TopicPartition {
+	g := b.groupLocked(c.group)
+	result := map[string]kafka.TopicPartition{}
+	for _, topic := range g.subscriptions[c] {
+		var subscribers []*Consumer
+		for _, member := range g.members {
+			if containsTopic(g.subscriptions[member], topic) {
+				subscribers = append(subscribers, member)
+			}
+		}
+		turn := 0
+		for i, member := range subscribers {
+			if member == c {
+				turn = i
+			}
+		}
+		for partition := turn; partition < len(b.topics[topic]); partition += len(subscribers) {
+			topic := topic
+			tp := kafka.TopicPartition{Topic: &topic, Partition: int32(partition)}
+			result[partitionKey(tp)] = tp
+		}
+	}
+	return result
+}
+
+func containsTopic(topics []string, topic string) bool {
+	for _, t := range topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,203 @@
+package kafkatest
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"sync"
+	"time"
+)
+
+// Producer writes to the Broker right away, or on commit when a transaction is open
+type Producer struct {
+	broker *Broker
+	events chan kafka.Event
+	// reports tracks delivery reports which are still being handed over
+	reports sync.WaitGroup
+
+	mu            sync.Mutex
+	closed        bool
+	done          chan struct{}
+	release       chan struct{}
+	transactional bool
+	transaction   *transaction
+}
+
+type transaction struct {
+	messages []*kafka.Message
+	offsets  map[string][]kafka.TopicPartition
+}
+
+// Events receives delivery reports of messages produced without a delivery channel
+func (p *Producer) Events() chan kafka.Event {
+	return p.events
+}
+
+func (p *Producer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return errClosed()
+	}
+
+	var report *kafka.Message
+	if p.transaction != nil {
+		report = p.stage(msg)
+	} else {
+		written, err := p.broker.append(msg)
+		if err != nil {
+			report = copyMessage(msg)
+			report.TopicPartition.Error = err
+		} else {
+			report = written
+		}
+	}
+	report.Opaque = msg.Opaque
+
+	if deliveryChan == nil {
+		deliveryChan = p.events
+	}
+	p.reports.Add(1)
+	go func(release chan struct{}) {
+		defer p.reports.Done()
+		if release != nil {
+			select {
+			case <-release:
+			case <-p.done:
+				return
+			}
+		}
+		deliveryChan <- report
+	}(p.release)
+	return nil
+}
+
+// Hold withholds the delivery reports of messages produced from now on until Release,
+// reports still held when the producer is closed are dropped
+func (p *Producer) Hold() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.release == nil {
+		p.release = make(chan struct{})
+	}
+}
+
+// Release hands over the delivery reports withheld since Hold
+func (p *Producer) Release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.release != nil {
+		close(p.release)
+		p.release = nil
+	}
+}
+
+// stage keeps msg until the transaction commits, its report has no offset yet
+func (p *Producer) stage(msg *kafka.Message) *kafka.Message {
+	report := copyMessage(msg)
+
+	p.broker.mu.Lock()
+	tp, err := p.broker.partitionLocked(msg)
+	p.broker.mu.Unlock()
+	if err != nil {
+		report.TopicPartition.Error = err
+		return report
+	}
+	tp.Offset = kafka.OffsetInvalid
+	report.TopicPartition = tp
+
+	staged := copyMessage(msg)
+	staged.TopicPartition = tp
+	p.transaction.messages = append(p.transaction.messages, staged)
+	return report
+}
+
+// Flush waits for delivery reports to be handed over, returning 1 when the timeout passed first
+func (p *Producer) Flush(timeoutMs int) int {
+	done := make(chan struct{})
+	go func() {
+		p.reports.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return 0
+	case <-time.After(time.Duration(timeoutMs) * time.Millisecond):
+		return 1
+	}
+}
+
+func (p *Producer) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+}
+
+func (p *Producer) GetMetadata(_ *string, _ bool, _ int) (*kafka.Metadata, error) {
+	return p.broker.metadata(), nil
+}
+
+func (p *Producer) GetFatalError() error {
+	return nil
+}
+
+func (p *Producer) InitTransactions(_ context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transactional = true
+	return nil
+}
+
+func (p *Producer) BeginTransaction() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.transactional {
+		return kafka.NewError(kafka.ErrState, "transactions are not initialized", false)
+	}
+	if p.transaction != nil {
+		return kafka.NewError(kafka.ErrState, "a transaction is already open", false)
+	}
+	p.transaction = &transaction{offsets: map[string][]kafka.TopicPartition{}}
+	return nil
+}
+
+func (p *Producer) SendOffsetsToTransaction(_ context.Context, offsets []kafka.TopicPartition, consumerMetadata *kafka.ConsumerGroupMetadata) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.transaction == nil {
+		return kafka.NewError(kafka.ErrState, "no transaction is open", false)
+	}
+	p.broker.mu.Lock()
+	group, ok := p.broker.members[consumerMetadata]
+	p.broker.mu.Unlock()
+	if !ok {
+		return kafka.NewError(kafka.ErrUnknownGroup, "consumer group metadata of another broker", false)
+	}
+	p.transaction.offsets[group] = append(p.transaction.offsets[group], offsets...)
+	return nil
+}
+
+// CommitTransaction makes staged messages visible and commits the offsets sent to the transaction
+// all at once, the transaction is aborted when any of the messages can't be written
+func (p *Producer) CommitTransaction(_ context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.transaction == nil {
+		return kafka.NewError(kafka.ErrState, "no transaction is open", false)
+	}
+	transaction := p.transaction
+	p.transaction = nil
+	return p.broker.commitTransaction(transaction.messages, transaction.offsets)
+}
+
+func (p *Producer) AbortTransaction(_ context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.transaction = nil
+	return nil
+}
@@ -0,0 +1,109 @@
+package kmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+const (
+	// HeaderMessageID identifies a message independently of where it is stored,
+	// messages without it are identified by topic, partition and offset
+	HeaderMessageID = "message-id"
+)
+
+// ProcessedMessagesMigration creates the ledger of WithIdempotency, services add it
+// to their migrations or run it through MigrateProcessedMessages
+const ProcessedMessagesMigration = `CREATE TABLE IF NOT EXISTS processed_messages (
+	consumer_group text NOT NULL,
+	message_id text NOT NULL,
+	processed_at timestamptz,
+	PRIMARY KEY (consumer_group, message_id)
+);
+CREATE INDEX IF NOT EXISTS idx_processed_messages_processed_at ON processed_messages (processed_at)`
+
+// MigrateProcessedMessages runs ProcessedMessagesMigration, it can be run again once applied
+func MigrateProcessedMessages(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Exec(ProcessedMessagesMigration).Error
+}
+
+// ProcessedMessageORM is a row of the processed_messages ledger, see ProcessedMessagesMigration
+type ProcessedMessageORM struct {
+	ConsumerGroup string    `gorm:"primaryKey;type:text"`
+	MessageID     string    `gorm:"primaryKey;type:text"`
+	ProcessedAt   time.Time `gorm:"index"`
+}
+
+func (*ProcessedMessageORM) TableName() string {
+	return "processed_messages"
+}
+
+// WithIdempotency records every handled message in the ledger within the transaction
+// handed to the handler, messages already in the ledger are skipped
+func WithIdempotency() ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.idempotent = true
+	}
+}
+
+func IdempotencyMiddleware(consumerGroup string) Middleware {
+	return func(next TopicHandler) TopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+			return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+				result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ProcessedMessageORM{
+					ConsumerGroup: consumerGroup,
+					MessageID:     messageID(msg),
+					ProcessedAt:   time.Now(),
+				})
+				if result.Error != nil {
+					return result.Error
+				}
+				if result.RowsAffected == 0 {
+					log := ctxlogrus.Extract(ctx)
+					log.Infof("skipping already processed message %v", messageID(msg))
+					return nil
+				}
+				return next(ctx, arguments, tx, msg)
+			})
+		}
+	}
+}
+
+func messageID(msg *kafka.Message) string {
+	if id, ok := HeaderValue(msg, HeaderMessageID); ok && id != "" {
+		return id
+	}
+	tp := msg.TopicPartition
+	return fmt.Sprintf("%v/%v@%v", *tp.Topic, tp.Partition, int64(tp.Offset))
+}
+
+func PruneProcessedMessages(ctx context.Context, db *gorm.DB, olderThan time.Time) (int64, error) {
+	result := db.WithContext(ctx).Where("processed_at < ?", olderThan).Delete(&ProcessedMessageORM{})
+	return result.RowsAffected, result.Error
+}
+
+// StartLedgerRetention prunes ledger rows older than retention every interval until ctx is done
+func StartLedgerRetention(ctx context.Context, db *gorm.DB, retention, interval time.Duration) {
+	log := ctxlogrus.Extract(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pruned, err := PruneProcessedMessages(ctx, db, time.Now().Add(-retention))
+			if err != nil {
+				log.Errorf("failed pruning processed messages %v", err)
+				continue
+			}
+			log.Debugf("pruned %v processed messages", pruned)
+		}
+	}
+}
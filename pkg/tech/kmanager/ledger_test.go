@@ -0,0 +1,165 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+// newMockDB returns a postgres gorm DB whose queries are checked by mock
+func newMockDB(t *testing.T) (*gorm.DB, sqlmock.Sqlmock) {
+	sqlDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = sqlDB.Close()
+	})
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sqlDB}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, mock
+}
+
+func TestMessageID(t *testing.T) {
+	orders := "orders"
+	tests := []struct {
+		name    string
+		headers []kafka.Header
+		want    string
+	}{
+		{
+			name:    "Message id header",
+			headers: []kafka.Header{{Key: HeaderMessageID, Value: []byte("9b2c")}},
+			want:    "9b2c",
+		},
+		{
+			name: "Last message id header",
+			headers: []kafka.Header{
+				{Key: HeaderMessageID, Value: []byte("9b2c")},
+				{Key: HeaderMessageID, Value: []byte("7f1e")},
+			},
+			want: "7f1e",
+		},
+		{
+			name:    "Empty message id falls back to the position",
+			headers: []kafka.Header{{Key: HeaderMessageID, Value: []byte("")}},
+			want:    "orders/3@42",
+		},
+		{
+			name: "Position",
+			want: "orders/3@42",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: 3, Offset: 42},
+				Headers:        tt.headers,
+			}
+			if got := messageID(msg); got != tt.want {
+				t.Errorf("TestMessageID(): messageID\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	orders := "orders"
+	msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: 0, Offset: 7}}
+
+	tests := []struct {
+		name     string
+		inserted int64
+		handled  bool
+	}{
+		{name: "New message is handled", inserted: 1, handled: true},
+		{name: "Processed message is skipped", inserted: 0, handled: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(`INSERT INTO "processed_messages" .* ON CONFLICT DO NOTHING`).
+				WithArgs("billing", "orders/0@7", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tt.inserted))
+			mock.ExpectCommit()
+
+			handled := false
+			handler := func(ctx context.Context, arguments *messaging.ContextualArguments, tx *gorm.DB, msg *kafka.Message) error {
+				handled = true
+				return nil
+			}
+			if err := IdempotencyMiddleware("billing")(handler)(context.Background(), nil, db, msg); err != nil {
+				t.Fatal(err)
+			}
+			if handled != tt.handled {
+				t.Errorf("TestIdempotencyMiddleware(): handled\ngot= \t%v\nwant = \t%v", handled, tt.handled)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPruneProcessedMessages(t *testing.T) {
+	cutoff := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	db, mock := newMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "processed_messages" WHERE processed_at < \$1`).
+		WithArgs(cutoff).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	pruned, err := PruneProcessedMessages(context.Background(), db, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 3 {
+		t.Errorf("TestPruneProcessedMessages(): pruned\ngot= \t%v\nwant = \t%v", pruned, 3)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateProcessedMessages(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS processed_messages \(`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := MigrateProcessedMessages(context.Background(), db); err != nil {
+		t.Errorf("TestMigrateProcessedMessages(): MigrateProcessedMessages\ngot= \t%v\nwant = \t%v", err, nil)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStartLedgerRetention(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM "processed_messages" WHERE processed_at < \$1`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		StartLedgerRetention(ctx, db, time.Hour, 10*time.Millisecond)
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		return mock.ExpectationsWereMet() == nil
+	})
+	cancel()
+	<-done
+}
@@ -1,17 +1,98 @@
 package kmanager
 
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"sort"
+)
 
 type Message interface {
 	Key() []byte
 	Value() []byte
 	Topic() *string
+	Headers() []kafka.Header
 }
 
+// HeaderMap is persisted as jsonb and converted to kafka headers when produced
+type HeaderMap map[string]string
+
+func (h HeaderMap) Value() (driver.Value, error) {
+	if h == nil {
+		return nil, nil
+	}
+	return json.Marshal(h)
+}
+
+func (h *HeaderMap) Scan(value interface{}) error {
+	// unmarshalling would otherwise merge into headers of a reused row
+	*h = nil
+	switch data := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return json.Unmarshal(data, h)
+	case string:
+		return json.Unmarshal([]byte(data), h)
+	default:
+		return fmt.Errorf("cannot scan %T into header map", value)
+	}
+}
+
+func (h HeaderMap) ToKafkaHeaders() []kafka.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	headers := make([]kafka.Header, len(keys))
+	for i, k := range keys {
+		headers[i] = kafka.Header{Key: k, Value: []byte(h[k])}
+	}
+	return headers
+}
+
+func HeaderValue(msg *kafka.Message, key string) (string, bool) {
+	// the last header wins when the key is repeated
+	for i := len(msg.Headers) - 1; i >= 0; i-- {
+		if msg.Headers[i].Key == key {
+			return string(msg.Headers[i].Value), true
+		}
+	}
+	return "", false
+}
+
+// OutboxMigration adds the columns of binary payloads and headers to an existing outbox table,
+// services add it to their migrations or run it through MigrateOutbox
+const OutboxMigration = `ALTER TABLE outbox
+	ADD COLUMN IF NOT EXISTS kafka_payload bytea,
+	ADD COLUMN IF NOT EXISTS content_type text,
+	ADD COLUMN IF NOT EXISTS kafka_headers jsonb`
+
+// MigrateOutbox runs OutboxMigration, it can be run again once applied
+func MigrateOutbox(ctx context.Context, db *gorm.DB) error {
+	return db.WithContext(ctx).Exec(OutboxMigration).Error
+}
+
+// OutboxORM is a row of the outbox table,
+// services migrate it with nullable `kafka_headers jsonb`, `kafka_payload bytea` and `content_type text` columns,
+// see OutboxMigration.
+// Binary or compressed events are stored in KafkaPayload, plain JSON ones in KafkaValue.
 type OutboxORM struct {
-	ID         uint   `gorm:"primarykey"`
-	KafkaTopic string `gorm:"type:text"`
-	KafkaKey   string `gorm:"type:text"`
-	KafkaValue string `gorm:"type:text"`
+	ID           uint      `gorm:"primarykey"`
+	KafkaTopic   string    `gorm:"type:text"`
+	KafkaKey     string    `gorm:"type:text"`
+	KafkaValue   string    `gorm:"type:text"`
+	KafkaPayload []byte    `gorm:"type:bytea"`
+	ContentType  string    `gorm:"type:text"`
+	KafkaHeaders HeaderMap `gorm:"type:jsonb"`
 }
 
 func (*OutboxORM) TableName() string {
@@ -22,28 +103,23 @@ func (o *OutboxORM) Key() []byte {
 	return []byte(o.KafkaKey)
 }
 func (o *OutboxORM) Value() []byte {
+	if o.KafkaPayload != nil {
+		return o.KafkaPayload
+	}
 	return []byte(o.KafkaValue)
 }
 func (o *OutboxORM) Topic() *string {
 	return &o.KafkaTopic
 }
-
-type DLQMessage struct {
-	MessageValue []byte
-	FormerTopic *string
-}
-
-func (m *DLQMessage) Key() []byte {
-	if m.FormerTopic == nil {
-		return []byte(("unknown_topic"))
+func (o *OutboxORM) Headers() []kafka.Header {
+	if o.ContentType == "" {
+		return o.KafkaHeaders.ToKafkaHeaders()
 	}
-	return []byte(*m.FormerTopic)
-}
-
-func (m *DLQMessage) Value() []byte {
-	return m.MessageValue
-}
-
-func (m *DLQMessage) Topic() *string {
-	return &DeadLetterQueueTopic
+	headers := HeaderMap{HeaderContentType: o.ContentType}
+	for k, v := range o.KafkaHeaders {
+		if k != HeaderContentType {
+			headers[k] = v
+		}
+	}
+	return headers.ToKafkaHeaders()
 }
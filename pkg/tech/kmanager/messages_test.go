@@ -0,0 +1,125 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderMapScan(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    HeaderMap
+		wantErr bool
+	}{
+		{name: "Null column", value: nil, want: nil},
+		{name: "Bytes", value: []byte(`{"tenant":"acme"}`), want: HeaderMap{"tenant": "acme"}},
+		{name: "String", value: `{"tenant":"acme"}`, want: HeaderMap{"tenant": "acme"}},
+		{name: "Unsupported type", value: 42, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := HeaderMap{"stale": "value"}
+			err := headers.Scan(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TestHeaderMapScan(): error\ngot= \t%v\nwant = \t%v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(headers, tt.want) {
+				t.Errorf("TestHeaderMapScan(): Scan\ngot= \t%v\nwant = \t%v", headers, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderMapValue(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers HeaderMap
+	}{
+		{name: "Nil map", headers: nil},
+		{name: "Headers", headers: HeaderMap{"tenant": "acme", "content-type": "application/json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, err := tt.headers.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var scanned HeaderMap
+			if err = scanned.Scan(value); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(scanned, tt.headers) {
+				t.Errorf("TestHeaderMapValue(): round trip\ngot= \t%v\nwant = \t%v", scanned, tt.headers)
+			}
+		})
+	}
+}
+
+func TestToKafkaHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers HeaderMap
+		want    []kafka.Header
+	}{
+		{name: "No headers", headers: HeaderMap{}, want: nil},
+		{
+			name:    "Sorted by key",
+			headers: HeaderMap{"tenant": "acme", "content-type": "application/json"},
+			want: []kafka.Header{
+				{Key: "content-type", Value: []byte("application/json")},
+				{Key: "tenant", Value: []byte("acme")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.headers.ToKafkaHeaders(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("TestToKafkaHeaders(): ToKafkaHeaders\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderValue(t *testing.T) {
+	msg := &kafka.Message{Headers: []kafka.Header{
+		{Key: "tenant", Value: []byte("first")},
+		{Key: "region", Value: []byte("eu")},
+		{Key: "tenant", Value: []byte("last")},
+	}}
+
+	tests := []struct {
+		name  string
+		key   string
+		want  string
+		found bool
+	}{
+		{name: "Last repeated header wins", key: "tenant", want: "last", found: true},
+		{name: "Single header", key: "region", want: "eu", found: true},
+		{name: "Missing header", key: "trace", want: "", found: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, found := HeaderValue(msg, tt.key)
+			if got != tt.want || found != tt.found {
+				t.Errorf("TestHeaderValue(): HeaderValue\ngot= \t%v %v\nwant = \t%v %v", got, found, tt.want, tt.found)
+			}
+		})
+	}
+}
+
+func TestMigrateOutbox(t *testing.T) {
+	db, mock := newMockDB(t)
+	mock.ExpectExec(`ALTER TABLE outbox\s+ADD COLUMN IF NOT EXISTS kafka_payload bytea`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := MigrateOutbox(context.Background(), db); err != nil {
+		t.Errorf("TestMigrateOutbox(): MigrateOutbox\ngot= \t%v\nwant = \t%v", err, nil)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
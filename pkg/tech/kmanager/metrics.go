@@ -0,0 +1,163 @@
+package kmanager
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strconv"
+	"time"
+)
+
+var (
+	MetricsNamespace = "kmanager"
+	// LagSampleInterval is how often the lag of assigned partitions is sampled
+	LagSampleInterval = 10 * time.Second
+)
+
+// Metrics collects consumer and producer statistics, a nil *Metrics records nothing
+type Metrics struct {
+	lag              *prometheus.GaugeVec
+	handlerDuration  *prometheus.HistogramVec
+	retries          *prometheus.CounterVec
+	deadLetters      *prometheus.CounterVec
+	deliveryFailures *prometheus.CounterVec
+}
+
+// NewMetrics registers the collectors with registerer, use prometheus.NewRegistry in tests
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	factory := promauto.With(registerer)
+	return &Metrics{
+		lag: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: MetricsNamespace,
+			Name:      "consumer_lag",
+			Help:      "Messages between the committed offset and the high watermark.",
+		}, []string{"topic", "partition"}),
+		handlerDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: MetricsNamespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Time spent in topic handlers per attempt.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic", "outcome"}),
+		retries: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "retries_total",
+			Help:      "Failed handler attempts which were retried in place or through a retry topic.",
+		}, []string{"topic"}),
+		deadLetters: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "dead_letters_total",
+			Help:      "Messages sent to the dead letter queue.",
+		}, []string{"topic"}),
+		deliveryFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Namespace: MetricsNamespace,
+			Name:      "producer_delivery_failures_total",
+			Help:      "Messages the producer failed to deliver.",
+		}, []string{"topic"}),
+	}
+}
+
+// WithMetrics records consumer statistics, including delivery failures of the DLQ producer
+func WithMetrics(metrics *Metrics) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.metrics = metrics
+	}
+}
+
+// sampleLag keeps sampling the lag of assigned partitions, including those nothing is
+// consumed from, until the returned func is called
+func (m *Metrics) sampleLag(consumer KafkaConsumer) func() {
+	if m == nil {
+		return func() {}
+	}
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(LagSampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				m.observeLag(consumer)
+			}
+		}
+	}()
+	// the consumer is closed once sampling stopped
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+func (m *Metrics) observeLag(consumer KafkaConsumer) {
+	timeout := int(LagSampleInterval.Milliseconds())
+	assignment, err := consumer.Assignment()
+	if err != nil || len(assignment) == 0 {
+		return
+	}
+	committed, err := consumer.Committed(assignment, timeout)
+	if err != nil {
+		return
+	}
+	for _, tp := range committed {
+		low, high, err := consumer.QueryWatermarkOffsets(*tp.Topic, tp.Partition, timeout)
+		if err != nil {
+			continue
+		}
+		offset := int64(tp.Offset)
+		if offset < 0 {
+			// nothing committed yet
+			offset = low
+		}
+		lag := high - offset
+		if lag < 0 {
+			lag = 0
+		}
+		m.lag.WithLabelValues(*tp.Topic, strconv.Itoa(int(tp.Partition))).Set(float64(lag))
+	}
+}
+
+func (m *Metrics) forgetPartitions(partitions []kafka.TopicPartition) {
+	if m == nil {
+		return
+	}
+	for _, tp := range partitions {
+		if tp.Topic != nil {
+			m.lag.DeleteLabelValues(*tp.Topic, strconv.Itoa(int(tp.Partition)))
+		}
+	}
+}
+
+func (m *Metrics) observeHandler(topic string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	m.handlerDuration.WithLabelValues(topic, outcome).Observe(elapsed.Seconds())
+}
+
+func (m *Metrics) retried(topic string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(topic).Inc()
+}
+
+func (m *Metrics) deadLettered(topic string) {
+	if m == nil {
+		return
+	}
+	m.deadLetters.WithLabelValues(topic).Inc()
+}
+
+func (m *Metrics) deliveryFailed(topic string) {
+	if m == nil {
+		return
+	}
+	m.deliveryFailures.WithLabelValues(topic).Inc()
+}
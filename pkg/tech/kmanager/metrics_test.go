@@ -0,0 +1,104 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gorm.io/gorm"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+
+	metrics.observeHandler("orders", time.Millisecond, nil)
+	metrics.observeHandler("orders", time.Millisecond, errors.New("boom"))
+	metrics.retried("orders")
+	metrics.retried("orders")
+	metrics.deadLettered("orders")
+	metrics.deliveryFailed("DLQ")
+
+	tests := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{name: "Retries", collector: metrics.retries.WithLabelValues("orders"), want: 2},
+		{name: "Dead letters", collector: metrics.deadLetters.WithLabelValues("orders"), want: 1},
+		{name: "Delivery failures", collector: metrics.deliveryFailures.WithLabelValues("DLQ"), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testutil.ToFloat64(tt.collector); got != tt.want {
+				t.Errorf("TestMetrics(): ToFloat64\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+
+	if count := testutil.CollectAndCount(metrics.handlerDuration); count != 2 {
+		t.Errorf("TestMetrics(): handler duration series\ngot= \t%v\nwant = \t%v", count, 2)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var metrics *Metrics
+	metrics.observeHandler("orders", time.Millisecond, nil)
+	metrics.retried("orders")
+	metrics.deadLettered("orders")
+	metrics.deliveryFailed("orders")
+	metrics.forgetPartitions(nil)
+}
+
+func TestLagSampling(t *testing.T) {
+	interval := LagSampleInterval
+	LagSampleInterval = 5 * time.Millisecond
+	defer func() {
+		LagSampleInterval = interval
+	}()
+
+	broker := kafkatest.NewBroker()
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	produce := func(count int) {
+		for i := 0; i < count; i++ {
+			if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	metrics := NewMetrics(prometheus.NewRegistry())
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"},
+		WithMetrics(metrics))
+
+	// the handler is stuck on the first message, nothing is consumed after it
+	release := make(chan bool)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mc.Start(context.Background(), func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+			<-release
+			return nil
+		})
+	}()
+	lag := func(want float64) func() bool {
+		return func() bool {
+			return testutil.ToFloat64(metrics.lag.WithLabelValues("orders", "0")) == want
+		}
+	}
+	produce(3)
+	waitFor(t, lag(3))
+	produce(2)
+	waitFor(t, lag(5))
+
+	close(release)
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
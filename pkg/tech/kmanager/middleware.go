@@ -0,0 +1,150 @@
+package kmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"gorm.io/gorm"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a TopicHandler, acting before and after it calls next
+type Middleware func(next TopicHandler) TopicHandler
+
+// Chain wraps handler so that the first middleware is the outermost one
+func Chain(handler TopicHandler, middlewares ...Middleware) TopicHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// WithMiddlewares wraps every handler attempt of the consumer in the middlewares,
+// they run within the span the consumer starts for each message
+func WithMiddlewares(middlewares ...Middleware) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.middlewares = append(mc.middlewares, middlewares...)
+	}
+}
+
+// TracingMiddleware starts a span continuing the trace carried by the message. Handlers run
+// by a MessageConsumer are already within the span it starts per message, there it starts none.
+func TracingMiddleware(name string) Middleware {
+	return func(next TopicHandler) TopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+			if isConsumerTraced(ctx) {
+				return next(ctx, arguments, db, msg)
+			}
+			ctx, span := TraceFromMessageNamed(ctx, msg, name)
+			defer span.End()
+
+			err := next(ctx, arguments, db, msg)
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return err
+		}
+	}
+}
+
+// LoggingMiddleware adds the message coordinates to the logger of the context
+func LoggingMiddleware() Middleware {
+	return func(next TopicHandler) TopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+			log := ctxlogrus.Extract(ctx).WithFields(logrus.Fields{
+				"topic":     *msg.TopicPartition.Topic,
+				"partition": msg.TopicPartition.Partition,
+				"offset":    msg.TopicPartition.Offset.String(),
+				"key":       string(msg.Key),
+			})
+			return next(ctxlogrus.ToContext(ctx, log), arguments, db, msg)
+		}
+	}
+}
+
+// RecoveryMiddleware turns handler panics into errors, keeping the consumer alive
+func RecoveryMiddleware() Middleware {
+	return func(next TopicHandler) TopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log := ctxlogrus.Extract(ctx)
+					log.Errorf("recovered from handler panic %v\n%s", r, debug.Stack())
+					err = fmt.Errorf("handler panicked: %v", r)
+				}
+			}()
+			return next(ctx, arguments, db, msg)
+		}
+	}
+}
+
+// TimingMiddleware logs how long the handler took
+func TimingMiddleware() Middleware {
+	return func(next TopicHandler) TopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+			start := time.Now()
+			err := next(ctx, arguments, db, msg)
+
+			log := ctxlogrus.Extract(ctx)
+			log.WithField("duration", time.Since(start).String()).Debug("handled kafka message")
+			return err
+		}
+	}
+}
+
+// BatchMiddleware wraps a BatchTopicHandler like Middleware wraps a TopicHandler
+type BatchMiddleware func(next BatchTopicHandler) BatchTopicHandler
+
+// ChainBatch wraps handler so that the first middleware is the outermost one
+func ChainBatch(handler BatchTopicHandler, middlewares ...BatchMiddleware) BatchTopicHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// WithBatchMiddlewares wraps every batch, and every message of a failed batch retried alone,
+// in the middlewares when consuming with StartBatch
+func WithBatchMiddlewares(middlewares ...BatchMiddleware) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.batchMiddlewares = append(mc.batchMiddlewares, middlewares...)
+	}
+}
+
+// BatchRecoveryMiddleware turns batch handler panics into errors failing the whole batch
+func BatchRecoveryMiddleware() BatchMiddleware {
+	return func(next BatchTopicHandler) BatchTopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					log := ctxlogrus.Extract(ctx)
+					log.Errorf("recovered from batch handler panic %v\n%s", r, debug.Stack())
+					err = fmt.Errorf("batch handler panicked: %v", r)
+				}
+			}()
+			return next(ctx, arguments, db, msgs)
+		}
+	}
+}
+
+// BatchTimingMiddleware logs how long the batch handler took
+func BatchTimingMiddleware() BatchMiddleware {
+	return func(next BatchTopicHandler) BatchTopicHandler {
+		return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msgs []*kafka.Message) error {
+			start := time.Now()
+			err := next(ctx, arguments, db, msgs)
+
+			log := ctxlogrus.Extract(ctx)
+			log.WithFields(logrus.Fields{
+				"duration": time.Since(start).String(),
+				"messages": len(msgs),
+			}).Debug("handled kafka batch")
+			return err
+		}
+	}
+}
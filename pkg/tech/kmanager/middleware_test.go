@@ -0,0 +1,163 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	named := func(name string) Middleware {
+		return func(next TopicHandler) TopicHandler {
+			return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				calls = append(calls, name+" before")
+				err := next(ctx, arguments, db, msg)
+				calls = append(calls, name+" after")
+				return err
+			}
+		}
+	}
+	handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+
+	if err := Chain(handler, named("outer"), named("inner"))(context.Background(), nil, nil, &kafka.Message{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"outer before", "inner before", "handler", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("TestChain(): calls\ngot= \t%v\nwant = \t%v", calls, want)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	failure := errors.New("database is down")
+	tests := []struct {
+		name    string
+		handler TopicHandler
+		err     string
+	}{
+		{
+			name: "Handled message",
+			handler: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				return nil
+			},
+		},
+		{
+			name: "Errors pass through",
+			handler: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				return failure
+			},
+			err: "database is down",
+		},
+		{
+			name: "Panic becomes an error",
+			handler: func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				panic("nil map")
+			},
+			err: "handler panicked: nil map",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Chain(tt.handler, RecoveryMiddleware())(context.Background(), nil, nil, &kafka.Message{})
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if !strings.Contains(got, tt.err) || (got == "") != (tt.err == "") {
+				t.Errorf("TestRecoveryMiddleware(): error\ngot= \t%v\nwant = \t%v", got, tt.err)
+			}
+		})
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	remote := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01},
+		SpanID:     trace.SpanID{0x02},
+		TraceFlags: trace.FlagsSampled,
+	})
+	remoteCtx := trace.ContextWithSpanContext(context.Background(), remote)
+
+	tests := []struct {
+		name   string
+		handle func(t *testing.T, handler TopicHandler)
+	}{
+		{
+			name: "Handler called directly",
+			handle: func(t *testing.T, handler TopicHandler) {
+				topic := "orders"
+				msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic}, Headers: InjectTraceHeaders(remoteCtx, nil)}
+				if err := Chain(handler, TracingMiddleware("EventConsumed"))(context.Background(), nil, nil, msg); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "Handler run by the consumer",
+			handle: func(t *testing.T, handler TopicHandler) {
+				broker := kafkatest.NewBroker()
+				producer := NewMessageProducerFromClient(broker.NewProducer())
+				if err := producer.ProduceMessage(remoteCtx, &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "{}"}); err != nil {
+					t.Fatal(err)
+				}
+				mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"},
+					WithMiddlewares(TracingMiddleware("EventConsumed")))
+
+				errs := make(chan error, 1)
+				go func() {
+					errs <- mc.Start(context.Background(), handler)
+				}()
+				waitFor(t, func() bool {
+					return broker.Committed("billing", "orders", 0) == 1
+				})
+				if err := mc.Close(); err != nil {
+					t.Fatal(err)
+				}
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := tracetest.NewSpanRecorder()
+			previous := otel.GetTracerProvider()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+			defer otel.SetTracerProvider(previous)
+
+			var traceID trace.TraceID
+			tt.handle(t, func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				traceID = trace.SpanContextFromContext(ctx).TraceID()
+				return nil
+			})
+
+			if traceID != remote.TraceID() {
+				t.Errorf("TestTracingMiddleware(): trace id\ngot= \t%v\nwant = \t%v", traceID, remote.TraceID())
+			}
+			spans := 0
+			for _, span := range recorder.Ended() {
+				if span.Name() == "EventConsumed" {
+					spans++
+				}
+			}
+			if spans != 1 {
+				t.Errorf("TestTracingMiddleware(): spans\ngot= \t%v\nwant = \t%v", spans, 1)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"sync"
+	"time"
+)
+
+// offsetTracker follows messages processed out of order and tells which offsets
+// are safe to commit, that is the highest offset every earlier message completed for
+type offsetTracker struct {
+	ctx        context.Context
+	mu         sync.Mutex
+	idle       *sync.Cond
+	partitions map[string]*partitionOffsets
+}
+
+// partitionOffsets is owned by the tracker until its partition is forgotten,
+// handlers of its messages run with its context which is cancelled then
+type partitionOffsets struct {
+	partition kafka.TopicPartition
+	// offsets in the order they were consumed, completed ones are popped from the front
+	inFlight  []kafka.Offset
+	completed map[kafka.Offset]bool
+	commit    kafka.Offset
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// running counts handlers of its messages which haven't returned yet
+	running int
+}
+
+func newOffsetTracker(ctx context.Context) *offsetTracker {
+	t := &offsetTracker{ctx: ctx, partitions: map[string]*partitionOffsets{}}
+	t.idle = sync.NewCond(&t.mu)
+	return t
+}
+
+// track adds the offset of tp to its partition, which is returned as the owner of the message
+func (t *offsetTracker) track(tp kafka.TopicPartition) *partitionOffsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := partitionKey(tp)
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &partitionOffsets{
+			partition: kafka.TopicPartition{Topic: tp.Topic, Partition: tp.Partition},
+			completed: map[kafka.Offset]bool{},
+			commit:    kafka.OffsetInvalid,
+		}
+		p.ctx, p.cancel = context.WithCancel(t.ctx)
+		t.partitions[key] = p
+	}
+	p.inFlight = append(p.inFlight, tp.Offset)
+	return p
+}
+
+// begin counts a handler of owner as running, false tells the partition was forgotten
+func (t *offsetTracker) begin(owner *partitionOffsets) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.partitions[partitionKey(owner.partition)] != owner {
+		return false
+	}
+	owner.running++
+	return true
+}
+
+// end is called once a handler counted by begin returned
+func (t *offsetTracker) end(owner *partitionOffsets) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	owner.running--
+	t.idle.Broadcast()
+}
+
+func (t *offsetTracker) complete(p *partitionOffsets, offset kafka.Offset) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.partitions[partitionKey(p.partition)] != p {
+		// partition was revoked in the meantime
+		return
+	}
+	p.completed[offset] = true
+	for len(p.inFlight) != 0 && p.completed[p.inFlight[0]] {
+		delete(p.completed, p.inFlight[0])
+		p.commit = p.inFlight[0] + 1
+		p.inFlight = p.inFlight[1:]
+	}
+	if len(p.inFlight) == 0 {
+		t.idle.Broadcast()
+	}
+}
+
+// untrack drops tp and the offsets consumed after it, which are known to never complete
+func (t *offsetTracker) untrack(tp kafka.TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[partitionKey(tp)]
+	if !ok {
+		return
+	}
+	for i, offset := range p.inFlight {
+		if offset == tp.Offset {
+			p.inFlight = p.inFlight[:i]
+			break
+		}
+	}
+	if len(p.inFlight) == 0 {
+		t.idle.Broadcast()
+	}
+}
+
+// commitable returns offsets which advanced since the last call
+func (t *offsetTracker) commitable() []kafka.TopicPartition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var result []kafka.TopicPartition
+	for _, p := range t.partitions {
+		if p.commit == kafka.OffsetInvalid {
+			continue
+		}
+		tp := p.partition
+		tp.Offset = p.commit
+		result = append(result, tp)
+		p.commit = kafka.OffsetInvalid
+	}
+	return result
+}
+
+// waitIdle blocks until the partitions have no messages in flight or the timeout passes,
+// returning whether they went idle
+func (t *offsetTracker) waitIdle(partitions []kafka.TopicPartition, timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.idle.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for t.inFlight(partitions) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		t.idle.Wait()
+	}
+	return true
+}
+
+func (t *offsetTracker) inFlight(partitions []kafka.TopicPartition) bool {
+	for _, tp := range partitions {
+		if p, ok := t.partitions[partitionKey(tp)]; ok && len(p.inFlight) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// forget drops partitions and cancels their handlers, late completions of their messages
+// are ignored and messages not started yet are skipped. The dropped partitions are returned.
+func (t *offsetTracker) forget(partitions []kafka.TopicPartition) []*partitionOffsets {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var forgotten []*partitionOffsets
+	for _, tp := range partitions {
+		key := partitionKey(tp)
+		if p, ok := t.partitions[key]; ok {
+			p.cancel()
+			forgotten = append(forgotten, p)
+			delete(t.partitions, key)
+		}
+	}
+	return forgotten
+}
+
+// waitStopped blocks until no handler of the forgotten partitions runs or the timeout passes,
+// returning whether they stopped
+func (t *offsetTracker) waitStopped(forgotten []*partitionOffsets, timeout time.Duration) bool {
+	timer := time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.idle.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for running(forgotten) {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		t.idle.Wait()
+	}
+	return true
+}
+
+func running(partitions []*partitionOffsets) bool {
+	for _, p := range partitions {
+		if p.running != 0 {
+			return true
+		}
+	}
+	return false
+}
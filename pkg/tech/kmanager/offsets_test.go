@@ -0,0 +1,152 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOffsetTracker(t *testing.T) {
+	topic := "orders"
+	at := func(offset kafka.Offset) kafka.TopicPartition {
+		return kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: offset}
+	}
+
+	tests := []struct {
+		name      string
+		consumed  []kafka.Offset
+		completed []kafka.Offset
+		commit    []kafka.Offset
+	}{
+		{
+			name:      "Nothing completed",
+			consumed:  []kafka.Offset{10, 11},
+			completed: []kafka.Offset{},
+			commit:    []kafka.Offset{},
+		},
+		{
+			name:      "Completed in order",
+			consumed:  []kafka.Offset{10, 11, 12},
+			completed: []kafka.Offset{10, 11},
+			commit:    []kafka.Offset{12},
+		},
+		{
+			name:      "Gap holds back the commit",
+			consumed:  []kafka.Offset{10, 11, 12},
+			completed: []kafka.Offset{11, 12},
+			commit:    []kafka.Offset{},
+		},
+		{
+			name:      "Gap is filled",
+			consumed:  []kafka.Offset{10, 11, 12},
+			completed: []kafka.Offset{12, 11, 10},
+			commit:    []kafka.Offset{13},
+		},
+		{
+			name:      "Skipped offsets are not waited for",
+			consumed:  []kafka.Offset{10, 15, 20},
+			completed: []kafka.Offset{10, 15},
+			commit:    []kafka.Offset{16},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newOffsetTracker(context.Background())
+			var owner *partitionOffsets
+			for _, offset := range tt.consumed {
+				owner = tracker.track(at(offset))
+			}
+			for _, offset := range tt.completed {
+				tracker.complete(owner, offset)
+			}
+
+			commit := []kafka.Offset{}
+			for _, tp := range tracker.commitable() {
+				commit = append(commit, tp.Offset)
+			}
+			if !reflect.DeepEqual(commit, tt.commit) {
+				t.Errorf("TestOffsetTracker(): commitable\ngot= \t%v\nwant = \t%v", commit, tt.commit)
+			}
+		})
+	}
+}
+
+func TestOffsetTrackerWaitIdle(t *testing.T) {
+	topic := "orders"
+	tp := kafka.TopicPartition{Topic: &topic, Partition: 1, Offset: 7}
+
+	tracker := newOffsetTracker(context.Background())
+	owner := tracker.track(tp)
+	if idle := tracker.waitIdle([]kafka.TopicPartition{tp}, 10*time.Millisecond); idle {
+		t.Errorf("TestOffsetTrackerWaitIdle(): waitIdle with message in flight\ngot= \t%v\nwant = \t%v", idle, false)
+	}
+
+	go tracker.complete(owner, tp.Offset)
+	if idle := tracker.waitIdle([]kafka.TopicPartition{tp}, time.Second); !idle {
+		t.Errorf("TestOffsetTrackerWaitIdle(): waitIdle once completed\ngot= \t%v\nwant = \t%v", idle, true)
+	}
+}
+
+func TestOffsetTrackerUntrack(t *testing.T) {
+	topic := "orders"
+	at := func(offset kafka.Offset) kafka.TopicPartition {
+		return kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: offset}
+	}
+
+	tracker := newOffsetTracker(context.Background())
+	var owner *partitionOffsets
+	for _, offset := range []kafka.Offset{10, 11, 12, 13} {
+		owner = tracker.track(at(offset))
+	}
+	tracker.untrack(at(12))
+	tracker.complete(owner, 10)
+	tracker.complete(owner, 11)
+	if idle := tracker.waitIdle([]kafka.TopicPartition{at(0)}, 10*time.Millisecond); !idle {
+		t.Errorf("TestOffsetTrackerUntrack(): waitIdle\ngot= \t%v\nwant = \t%v", idle, true)
+	}
+	commit := tracker.commitable()
+	if len(commit) != 1 || commit[0].Offset != 12 {
+		t.Errorf("TestOffsetTrackerUntrack(): commitable\ngot= \t%v\nwant = \t%v", commit, 12)
+	}
+}
+
+func TestOffsetTrackerForget(t *testing.T) {
+	topic := "orders"
+	tp := kafka.TopicPartition{Topic: &topic, Partition: 0, Offset: 7}
+
+	tracker := newOffsetTracker(context.Background())
+	handling := tracker.track(tp)
+	tp.Offset++
+	queued := tracker.track(tp)
+	if !tracker.begin(handling) {
+		t.Fatalf("TestOffsetTrackerForget(): begin\ngot= \t%v\nwant = \t%v", false, true)
+	}
+
+	forgotten := tracker.forget([]kafka.TopicPartition{tp})
+	if handling.ctx.Err() == nil {
+		t.Errorf("TestOffsetTrackerForget(): handler context\ngot= \t%v\nwant = \t%v", nil, context.Canceled)
+	}
+	if began := tracker.begin(queued); began {
+		t.Errorf("TestOffsetTrackerForget(): begin of a forgotten partition\ngot= \t%v\nwant = \t%v", began, false)
+	}
+	if stopped := tracker.waitStopped(forgotten, 10*time.Millisecond); stopped {
+		t.Errorf("TestOffsetTrackerForget(): waitStopped with a running handler\ngot= \t%v\nwant = \t%v", stopped, false)
+	}
+
+	go func() {
+		tracker.complete(handling, 7)
+		tracker.end(handling)
+	}()
+	if stopped := tracker.waitStopped(forgotten, time.Second); !stopped {
+		t.Errorf("TestOffsetTrackerForget(): waitStopped\ngot= \t%v\nwant = \t%v", stopped, true)
+	}
+
+	// a partition tracked again has a new owner
+	tracker.track(tp)
+	if commit := tracker.commitable(); len(commit) != 0 {
+		t.Errorf("TestOffsetTrackerForget(): commitable\ngot= \t%v\nwant = \t%v", commit, nil)
+	}
+}
@@ -2,29 +2,83 @@ package kmanager
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
 	"github.com/Cobalt0s/creme-brulee/pkg/stateful/config"
 	"github.com/Cobalt0s/creme-brulee/pkg/stateful/logging"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/google/uuid"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
-	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
 	"gorm.io/gorm"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultKafkaKey is used for events which have neither a partition key nor an aggregate id
+	DefaultKafkaKey = "some-kafka-key"
+	// AggregateIDFields are looked up in the event payload when the event has no partition key.
+	// `id` usually names the event rather than its aggregate, services keying by it add it here.
+	AggregateIDFields = []string{"aggregateId"}
+	// CompressThreshold is the size in bytes above which events are gzipped, zero disables compression
+	CompressThreshold = 0
+)
+
+const (
+	// HeaderEventType names the type of binary events, which can't be peeked at like JSON ones
+	HeaderEventType = "event-type"
 )
 
 func SendEvent(ctx context.Context, tx *gorm.DB, topic string, event messaging.JSONConvertable) error {
 	ctx, span := logging.StartSpan(ctx, "SendEvent")
 	defer span.End()
+
+	return sendEvent(ctx, tx, topic, nil, event)
+}
+
+func SendEventWithKey(ctx context.Context, tx *gorm.DB, topic, key string, event messaging.JSONConvertable) error {
+	ctx, span := logging.StartSpan(ctx, "SendEventWithKey")
+	defer span.End()
+
+	return sendEvent(ctx, tx, topic, &key, event)
+}
+
+func sendEvent(ctx context.Context, tx *gorm.DB, topic string, key *string, event messaging.JSONConvertable) error {
 	log := ctxlogrus.Extract(ctx)
 
-	jsonData, err := event.ToJSON()
+	outboxORM, err := newOutboxORM(ctx, topic, key, event)
+	if err != nil {
+		return err
+	}
+	if err = tx.Create(outboxORM).Error; err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// SendEncodedEvent stores event encoded by codec, the consumer decodes it by the content type
+// and eventType headers
+func SendEncodedEvent(ctx context.Context, tx *gorm.DB, topic, eventType string, event interface{}, codec messaging.Codec) error {
+	ctx, span := logging.StartSpan(ctx, "SendEncodedEvent")
+	defer span.End()
+	log := ctxlogrus.Extract(ctx)
+
+	payload, err := codec.Encode(event)
 	if err != nil {
 		return err
 	}
-	if err = tx.Create(&OutboxORM{
-		KafkaTopic: topic,
-		KafkaKey:   "some-kafka-key",
-		KafkaValue: jsonData,
-	}).Error; err != nil {
+	headers := eventHeaders(ctx, event)
+	headers[HeaderEventType] = eventType
+	outboxORM := &OutboxORM{
+		KafkaTopic:   topic,
+		KafkaKey:     resolveKafkaKey(event, ""),
+		KafkaPayload: payload,
+		ContentType:  codec.ContentType(),
+		KafkaHeaders: headers,
+	}
+	if err = tx.Create(outboxORM).Error; err != nil {
 		log.Error(err)
 		return err
 	}
@@ -43,15 +97,11 @@ func SendEvents(ctx context.Context, tx *gorm.DB, topic string, events []messagi
 
 	outboxORMs := make([]OutboxORM, len(events))
 	for i, e := range events {
-		jsonData, err := e.ToJSON()
+		outboxORM, err := newOutboxORM(ctx, topic, nil, e)
 		if err != nil {
 			return err
 		}
-		outboxORMs[i] = OutboxORM{
-			KafkaTopic: topic,
-			KafkaKey:   "some-kafka-key",
-			KafkaValue: jsonData,
-		}
+		outboxORMs[i] = *outboxORM
 	}
 
 	if err := tx.Create(outboxORMs).Error; err != nil {
@@ -61,52 +111,178 @@ func SendEvents(ctx context.Context, tx *gorm.DB, topic string, events []messagi
 	return nil
 }
 
+func newOutboxORM(ctx context.Context, topic string, key *string, event messaging.JSONConvertable) (*OutboxORM, error) {
+	jsonData, err := event.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	// unregistered event types pass through, as they do when consumed
+	if messaging.DefaultEventRegistry != nil && messaging.DefaultEventRegistry.Registered([]byte(jsonData)) {
+		validated, err := messaging.DefaultEventRegistry.ValidateOutgoing([]byte(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		jsonData = string(validated)
+	}
+	if key == nil {
+		resolved := resolveKafkaKey(event, jsonData)
+		key = &resolved
+	}
+	headers := eventHeaders(ctx, event)
+	// the id and time stay those of the event however often the row is relayed
+	if headers[HeaderMessageID] == "" {
+		headers[HeaderMessageID] = uuid.New().String()
+	}
+	if headers[HeaderEventTime] == "" {
+		headers[HeaderEventTime] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	outboxORM := &OutboxORM{
+		KafkaTopic:   topic,
+		KafkaKey:     *key,
+		KafkaHeaders: headers,
+	}
+	if CompressThreshold > 0 && len(jsonData) > CompressThreshold {
+		contentType := headers[HeaderContentType]
+		if contentType == "" {
+			contentType = messaging.JSONContentType
+		}
+		if outboxORM.KafkaPayload, err = messaging.Compress([]byte(jsonData)); err != nil {
+			return nil, err
+		}
+		outboxORM.ContentType = messaging.CompressedContentType(contentType)
+		return outboxORM, nil
+	}
+	outboxORM.KafkaValue = jsonData
+	return outboxORM, nil
+}
+
+func eventHeaders(ctx context.Context, event interface{}) HeaderMap {
+	headers := HeaderMap{}
+	if provider, ok := event.(messaging.HeadersProvider); ok {
+		for k, v := range provider.EventHeaders() {
+			headers[k] = v
+		}
+	}
+	// relayed events continue the trace of the request which emitted them
+	Propagator.Inject(ctx, propagation.MapCarrier(headers))
+	return headers
+}
+
+// isPlainJSON tells whether the value is an uncompressed JSON event, CloudEvents aside,
+// which the legacy trace can be injected into
+func isPlainJSON(headers []kafka.Header) bool {
+	if isCloudEvent(headers) {
+		return false
+	}
+	contentType, _ := HeaderValue(&kafka.Message{Headers: headers}, HeaderContentType)
+	return contentType == messaging.JSONContentType || contentType == ""
+}
+
+func resolveKafkaKey(event interface{}, jsonData string) string {
+	if keyed, ok := event.(messaging.PartitionKeyed); ok {
+		if key := keyed.PartitionKey(); key != "" {
+			return key
+		}
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonData), &payload); err == nil {
+		for _, field := range AggregateIDFields {
+			if id, ok := payload[field].(string); ok && id != "" {
+				return id
+			}
+		}
+	}
+	return DefaultKafkaKey
+}
+
 type MessageProducer struct {
-	producer *kafka.Producer
+	producer KafkaProducer
+	metrics  *Metrics
+
+	cloudEvents       CloudEventsMode
+	cloudEventsSource string
+	orderedDelivery   bool
+
+	transactional bool
+	// txMu serializes transactions, a producer runs one at a time
+	txMu sync.Mutex
+
+	mu         sync.Mutex
+	closed     bool
+	deliveries chan kafka.Event
+	pending    map[*Delivery]bool
+}
+
+type ProducerOption func(p *MessageProducer)
+
+// WithProducerMetrics counts messages which failed to be delivered
+func WithProducerMetrics(metrics *Metrics) ProducerOption {
+	return func(p *MessageProducer) {
+		p.metrics = metrics
+	}
+}
+
+// WithOrderedDelivery tells that the client keeps messages of a partition in order when retrying them,
+// as it does with enable.idempotence or max.in.flight of 1
+func WithOrderedDelivery() ProducerOption {
+	return func(p *MessageProducer) {
+		p.orderedDelivery = true
+	}
 }
 
-func NewMessageProducer(cfg *config.KafkaConfig, clientID string) (*MessageProducer, error) {
+// NewMessageProducer has ordered delivery when cfg enables idempotence
+func NewMessageProducer(cfg *config.KafkaConfig, clientID string, opts ...ProducerOption) (*MessageProducer, error) {
 	kafkaConfigMap := cfg.GetKafkaConfigMapProducer(clientID)
 	producer, err := kafka.NewProducer(kafkaConfigMap)
 	if err != nil {
 		return nil, err
 	}
-	return &MessageProducer{producer: producer}, nil
+	if cfg.EnableIdempotence {
+		opts = append([]ProducerOption{WithOrderedDelivery()}, opts...)
+	}
+	return NewMessageProducerFromClient(producer, opts...), nil
 }
 
-func (p *MessageProducer) ProduceMessage(ctx context.Context, message Message) error {
-	key := message.Key()
-	value := message.Value()
-
-	ctx, span := TraceFromEventNamed(ctx, value, "Harvested")
-	defer span.End()
-	log := ctxlogrus.Extract(ctx)
-
-	delivery := make(chan kafka.Event, 1)
-
-	err := p.producer.Produce(&kafka.Message{
-		TopicPartition: kafka.TopicPartition{Topic: message.Topic(), Partition: kafka.PartitionAny},
-		Key:            key,
-		Value:          enhanceWithCurrentTrace(ctx, value),
-	},
-		delivery,
-	)
-	if err != nil {
-		log.Error("failed to enqueue message for kafka producer")
-		return err
+// NewMessageProducerFromClient wraps an existing kafka client, such as the in memory one of kafkatest
+func NewMessageProducerFromClient(producer KafkaProducer, opts ...ProducerOption) *MessageProducer {
+	p := &MessageProducer{producer: producer}
+	for _, opt := range opts {
+		opt(p)
 	}
+	return p
+}
 
-	output := <-delivery
-	messageReport := output.(*kafka.Message)
+// ProduceMessage blocks until message is acknowledged, see ProduceAsync and ProduceMessages
+// for sending many messages without a round trip each
+func (p *MessageProducer) ProduceMessage(ctx context.Context, message Message) error {
+	log := ctxlogrus.Extract(ctx)
 
-	err = messageReport.TopicPartition.Error
+	report, err := p.ProduceAsync(ctx, message).Wait(ctx)
 	if err != nil {
 		log.Error("failed sending message")
-		span.SetStatus(codes.Error, "failed sending message")
 		return err
-	} else {
-		log.Debugf("Message delivered %v", string(messageReport.Value))
 	}
-
+	log.Debugf("Message delivered to %v", report)
 	return nil
 }
+
+// toKafkaMessage carries the trace of ctx in the headers, and in the value when legacy tracing is on.
+// Outbox events are wrapped in CloudEvents when the producer sends them, CloudEvents don't get
+// the legacy trace as it isn't a valid extension.
+func (p *MessageProducer) toKafkaMessage(ctx context.Context, message Message) (*kafka.Message, error) {
+	value, headers := message.Value(), message.Headers()
+	if _, ok := message.(*OutboxORM); ok && p.cloudEvents != CloudEventsDisabled && isPlainJSON(headers) {
+		var err error
+		if value, headers, err = p.wrapCloudEvent(message); err != nil {
+			return nil, err
+		}
+	} else if InjectLegacyTrace && isPlainJSON(headers) {
+		value = enhanceWithCurrentTrace(ctx, value)
+	}
+	return &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: message.Topic(), Partition: kafka.PartitionAny},
+		Key:            message.Key(),
+		Value:          value,
+		Headers:        InjectTraceHeaders(ctx, headers),
+	}, nil
+}
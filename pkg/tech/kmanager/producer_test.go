@@ -0,0 +1,156 @@
+package kmanager
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"testing"
+)
+
+type jsonEvent string
+
+func (e jsonEvent) ToJSON() (string, error) {
+	return string(e), nil
+}
+
+func TestNewOutboxORMCompression(t *testing.T) {
+	event := jsonEvent(`{"type":"OrderPlaced","aggregateId":"42"}`)
+
+	tests := []struct {
+		name        string
+		threshold   int
+		contentType string
+	}{
+		{name: "Compression disabled", threshold: 0, contentType: ""},
+		{name: "Small event", threshold: 1024, contentType: ""},
+		{name: "Large event", threshold: 8, contentType: "application/json+gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			CompressThreshold = tt.threshold
+			defer func() {
+				CompressThreshold = 0
+			}()
+
+			outboxORM, err := newOutboxORM(context.Background(), "orders", nil, event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outboxORM.KafkaKey != "42" {
+				t.Errorf("TestNewOutboxORMCompression(): key\ngot= \t%v\nwant = \t%v", outboxORM.KafkaKey, "42")
+			}
+			contentType, _ := HeaderValue(&kafka.Message{Headers: outboxORM.Headers()}, HeaderContentType)
+			if contentType != tt.contentType {
+				t.Errorf("TestNewOutboxORMCompression(): content type\ngot= \t%v\nwant = \t%v", contentType, tt.contentType)
+			}
+
+			codec, _ := messaging.CodecFor(contentType)
+			var value json.RawMessage
+			if err = codec.Decode(outboxORM.Value(), &value); err != nil {
+				t.Fatal(err)
+			}
+			if string(value) != string(event) {
+				t.Errorf("TestNewOutboxORMCompression(): value\ngot= \t%v\nwant = \t%v", string(value), event)
+			}
+		})
+	}
+}
+
+type keyedEvent struct {
+	jsonEvent
+	key string
+}
+
+func (e keyedEvent) PartitionKey() string {
+	return e.key
+}
+
+func TestResolveKafkaKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		event messaging.JSONConvertable
+		want  string
+	}{
+		{
+			name:  "Partition key of the event",
+			event: keyedEvent{jsonEvent: `{"aggregateId":"7","id":"42"}`, key: "tenant-1"},
+			want:  "tenant-1",
+		},
+		{
+			name:  "Empty partition key falls back to the payload",
+			event: keyedEvent{jsonEvent: `{"aggregateId":"42"}`},
+			want:  "42",
+		},
+		{
+			name:  "Aggregate id",
+			event: jsonEvent(`{"aggregateId":"7","id":"42"}`),
+			want:  "7",
+		},
+		{
+			name:  "Event id is not a key",
+			event: jsonEvent(`{"id":"42"}`),
+			want:  DefaultKafkaKey,
+		},
+		{
+			name:  "Non string ids are ignored",
+			event: jsonEvent(`{"aggregateId":42}`),
+			want:  DefaultKafkaKey,
+		},
+		{
+			name:  "Default key",
+			event: jsonEvent(`{"type":"OrderPlaced"}`),
+			want:  DefaultKafkaKey,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonData, err := tt.event.ToJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := resolveKafkaKey(tt.event, jsonData); got != tt.want {
+				t.Errorf("TestResolveKafkaKey(): resolveKafkaKey\ngot= \t%v\nwant = \t%v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOutboxORMRegistry(t *testing.T) {
+	registry := messaging.NewEventRegistry()
+	if err := registry.Register("OrderPlaced", 2, orderPlaced{}); err != nil {
+		t.Fatal(err)
+	}
+	messaging.DefaultEventRegistry = registry
+	defer func() {
+		messaging.DefaultEventRegistry = nil
+	}()
+
+	tests := []struct {
+		name  string
+		event jsonEvent
+		want  string
+	}{
+		{
+			name:  "Registered event is stamped with its version",
+			event: `{"type":"OrderPlaced","id":"42"}`,
+			want:  `{"id":"42","type":"OrderPlaced","version":2}`,
+		},
+		{
+			name:  "Unregistered event passes through",
+			event: `{"type":"OrderCancelled","id":"42"}`,
+			want:  `{"type":"OrderCancelled","id":"42"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outboxORM, err := newOutboxORM(context.Background(), "orders", nil, tt.event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if outboxORM.KafkaValue != tt.want {
+				t.Errorf("TestNewOutboxORMRegistry(): value\ngot= \t%v\nwant = \t%v", outboxORM.KafkaValue, tt.want)
+			}
+		})
+	}
+}
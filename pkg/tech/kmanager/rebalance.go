@@ -0,0 +1,113 @@
+package kmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"strings"
+)
+
+type PartitionHook func(ctx context.Context, partitions []kafka.TopicPartition)
+
+// RebalanceHooks are called from the consumer loop while the group rebalances.
+// OnRevoked runs after processed offsets of the partitions were committed,
+// OnLost runs when partitions were taken away before they could be committed.
+type RebalanceHooks struct {
+	OnAssigned PartitionHook
+	OnRevoked  PartitionHook
+	OnLost     PartitionHook
+}
+
+func WithRebalanceHooks(hooks RebalanceHooks) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.hooks = hooks
+	}
+}
+
+func (mc *MessageConsumer) rebalance(ctx context.Context) kafka.RebalanceCb {
+	return func(_ *kafka.Consumer, event kafka.Event) error {
+		log := ctxlogrus.Extract(ctx)
+
+		switch e := event.(type) {
+		case kafka.AssignedPartitions:
+			log.Infof("assigned partitions %v", formatPartitions(e.Partitions))
+			if mc.hooks.OnAssigned != nil {
+				mc.hooks.OnAssigned(ctx, e.Partitions)
+			}
+		case kafka.RevokedPartitions:
+			if mc.consumer.AssignmentLost() {
+				log.Warnf("lost partitions %v", formatPartitions(e.Partitions))
+				mc.revoke(ctx, e.Partitions, false)
+				if mc.hooks.OnLost != nil {
+					mc.hooks.OnLost(ctx, e.Partitions)
+				}
+				return nil
+			}
+			log.Infof("revoked partitions %v", formatPartitions(e.Partitions))
+			mc.revoke(ctx, e.Partitions, true)
+			if mc.hooks.OnRevoked != nil {
+				mc.hooks.OnRevoked(ctx, e.Partitions)
+			}
+		}
+		// partitions are (un)assigned by the kafka client once the callback returns
+		return nil
+	}
+}
+
+// revoke lets in flight work of the partitions finish and commits it before they are handed over,
+// lost partitions are no longer ours to commit so their work is abandoned. Either way handlers
+// of the partitions have returned before they are handed over, unless they ignore cancellation.
+func (mc *MessageConsumer) revoke(ctx context.Context, partitions []kafka.TopicPartition, commit bool) {
+	log := ctxlogrus.Extract(ctx)
+
+	for _, tp := range partitions {
+		delete(mc.pausedRetries, partitionKey(tp))
+	}
+	mc.metrics.forgetPartitions(partitions)
+	if mc.batch != nil {
+		mc.revokeBatch(ctx, partitions, commit)
+	}
+	if mc.pool == nil {
+		return
+	}
+	mc.pool.dropBacklog(partitions)
+	if commit {
+		if !mc.pool.tracker.waitIdle(partitions, RevokeDrainTimeout) {
+			log.Warnf("abandoning in flight messages of revoked partitions %v", formatPartitions(partitions))
+		}
+		mc.commitCompleted(ctx)
+	}
+	// queued messages are skipped and running handlers cancelled, the new owner handles them
+	forgotten := mc.pool.tracker.forget(partitions)
+	if !mc.pool.tracker.waitStopped(forgotten, RevokeDrainTimeout) {
+		log.Warnf("handlers of revoked partitions %v ignore cancellation", formatPartitions(partitions))
+	}
+}
+
+// revokeBatch handles the pending batch messages of revoked partitions so their offsets are
+// committed before the hand over, pending messages of lost partitions are dropped
+func (mc *MessageConsumer) revokeBatch(ctx context.Context, partitions []kafka.TopicPartition, commit bool) {
+	if !commit {
+		mc.batch.drop(partitions)
+		return
+	}
+	drainCtx, cancel := context.WithTimeout(ctx, RevokeDrainTimeout)
+	defer cancel()
+	if err := mc.batch.drain(drainCtx, partitions); err != nil {
+		log := ctxlogrus.Extract(ctx)
+		log.Warnf("abandoning pending batch of revoked partitions %v: %v", formatPartitions(partitions), err)
+	}
+}
+
+func formatPartitions(partitions []kafka.TopicPartition) string {
+	result := make([]string, len(partitions))
+	for i, tp := range partitions {
+		topic := ""
+		if tp.Topic != nil {
+			topic = *tp.Topic
+		}
+		result[i] = fmt.Sprintf("%v[%v]", topic, tp.Partition)
+	}
+	return strings.Join(result, ",")
+}
@@ -0,0 +1,97 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRevokeInFlightMessages(t *testing.T) {
+	RevokeDrainTimeout = 20 * time.Millisecond
+	defer func() {
+		RevokeDrainTimeout = 30 * time.Second
+	}()
+
+	// the second member of the group takes over partition 1, where keys hashing like "b" go
+	broker := kafkatest.NewBroker()
+	broker.CreateTopic("orders", 2)
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	for i := 0; i < 3; i++ {
+		if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "b", KafkaValue: "placed"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var firstCalls int32
+	started := make(chan bool)
+	cancelled := make(chan bool)
+	first := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		if atomic.AddInt32(&firstCalls, 1) == 1 {
+			close(started)
+		}
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	}
+	var mu sync.Mutex
+	var revoked []kafka.TopicPartition
+	hooks := RebalanceHooks{OnRevoked: func(ctx context.Context, partitions []kafka.TopicPartition) {
+		mu.Lock()
+		defer mu.Unlock()
+		revoked = append(revoked, partitions...)
+	}}
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"},
+		WithConcurrency(2), WithRetryPolicy(NoRetries()), WithRebalanceHooks(hooks))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mc.Start(context.Background(), first)
+	}()
+	<-started
+
+	var secondCalls int32
+	second := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		atomic.AddInt32(&secondCalls, 1)
+		return nil
+	}
+	other := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"},
+		WithConcurrency(2), WithRetryPolicy(NoRetries()))
+	otherErrs := make(chan error, 1)
+	go func() {
+		otherErrs <- other.Start(context.Background(), second)
+	}()
+
+	<-cancelled
+	waitFor(t, func() bool {
+		return broker.Committed("billing", "orders", 1) == 3
+	})
+	for _, c := range []*MessageConsumer{mc, other} {
+		if err := c.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-otherErrs; err != nil {
+		t.Fatal(err)
+	}
+
+	if calls := atomic.LoadInt32(&firstCalls); calls != 1 {
+		t.Errorf("TestRevokeInFlightMessages(): calls of the revoked member\ngot= \t%v\nwant = \t%v", calls, 1)
+	}
+	if calls := atomic.LoadInt32(&secondCalls); calls != 3 {
+		t.Errorf("TestRevokeInFlightMessages(): calls of the new owner\ngot= \t%v\nwant = \t%v", calls, 3)
+	}
+	if len(revoked) == 0 || revoked[0].Partition != 1 {
+		t.Errorf("TestRevokeInFlightMessages(): revoked\ngot= \t%v\nwant = \t%v", formatPartitions(revoked), "orders[1]")
+	}
+	if deadLetters := len(broker.Messages(DeadLetterQueueTopic)); deadLetters != 0 {
+		t.Errorf("TestRevokeInFlightMessages(): dead letters\ngot= \t%v\nwant = \t%v", deadLetters, 0)
+	}
+}
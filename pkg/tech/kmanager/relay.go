@@ -0,0 +1,166 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"gorm.io/gorm"
+	"time"
+)
+
+var (
+	// OutboxRelayLockID is the postgres advisory lock guarding the outbox,
+	// only the replica holding it drains rows so insertion order is kept
+	OutboxRelayLockID int64 = 7_309_210_844
+	// DefaultOutboxBatchSize and DefaultOutboxPollInterval replace non positive values given to NewOutboxRelay
+	DefaultOutboxBatchSize    = 100
+	DefaultOutboxPollInterval = time.Second
+)
+
+type MessageSender interface {
+	ProduceMessage(ctx context.Context, message Message) error
+}
+
+// BatchMessageSender is optionally implemented by senders able to deliver many messages in one go,
+// such as MessageProducer. Batches are only sent when OrderedDelivery holds, otherwise a retried
+// message could land after the ones following it.
+type BatchMessageSender interface {
+	ProduceMessages(ctx context.Context, messages []Message) error
+	OrderedDelivery() bool
+}
+
+// OutboxRelay publishes rows written by SendEvent and SendEvents to kafka.
+// Rows are deleted only once their delivery was confirmed by the broker.
+type OutboxRelay struct {
+	db           *gorm.DB
+	sender       MessageSender
+	batchSize    int
+	pollInterval time.Duration
+	stop         chan bool
+}
+
+func NewOutboxRelay(db *gorm.DB, sender MessageSender, batchSize int, pollInterval time.Duration) *OutboxRelay {
+	if batchSize <= 0 {
+		batchSize = DefaultOutboxBatchSize
+	}
+	if pollInterval <= 0 {
+		pollInterval = DefaultOutboxPollInterval
+	}
+	return &OutboxRelay{
+		db:           db,
+		sender:       sender,
+		batchSize:    batchSize,
+		pollInterval: pollInterval,
+		stop:         make(chan bool, 1),
+	}
+}
+
+func (r *OutboxRelay) Close() {
+	select {
+	case r.stop <- true:
+	default:
+	}
+}
+
+func (r *OutboxRelay) Start(ctx context.Context) error {
+	log := ctxlogrus.Extract(ctx)
+	log.Info("starting outbox relay")
+
+	for {
+		delivered, err := r.Drain(ctx)
+		if err != nil {
+			log.Errorf("failed relaying outbox %v", err)
+		}
+		if err == nil && delivered == r.batchSize {
+			// outbox is not empty yet, keep draining
+			continue
+		}
+
+		select {
+		case <-r.stop:
+			log.Info("stopping outbox relay")
+			return nil
+		case <-ctx.Done():
+			log.Info("stopping outbox relay")
+			return ctx.Err()
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// Drain publishes a single batch of outbox rows returning how many were delivered.
+// It is a no op when another replica is already draining the outbox.
+func (r *OutboxRelay) Drain(ctx context.Context) (int, error) {
+	var delivered []uint
+	var sendErr error
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var locked bool
+		if err := tx.Raw("SELECT pg_try_advisory_xact_lock(?)", OutboxRelayLockID).Scan(&locked).Error; err != nil {
+			return err
+		}
+		if !locked {
+			return nil
+		}
+
+		var rows []OutboxORM
+		if err := tx.Order("id").Limit(r.batchSize).Find(&rows).Error; err != nil {
+			return err
+		}
+
+		delivered, sendErr = publishInOrder(ctx, r.sender, rows)
+		if len(delivered) == 0 {
+			return nil
+		}
+		return tx.Delete(&OutboxORM{}, delivered).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(delivered), sendErr
+}
+
+// publishInOrder stops at the first failure, rows after it must not overtake it
+func publishInOrder(ctx context.Context, sender MessageSender, rows []OutboxORM) ([]uint, error) {
+	if batchSender, ok := sender.(BatchMessageSender); ok && batchSender.OrderedDelivery() {
+		return publishBatch(ctx, batchSender, rows)
+	}
+	delivered := make([]uint, 0, len(rows))
+	for i := range rows {
+		if err := sender.ProduceMessage(ctx, &rows[i]); err != nil {
+			return delivered, err
+		}
+		delivered = append(delivered, rows[i].ID)
+	}
+	return delivered, nil
+}
+
+// publishBatch sends all rows at once, only rows before the first failure count as delivered
+// so the rest are sent again in order, possibly duplicating some of them.
+// Ordered delivery keeps rows in order through transient failures, but a row failing for good
+// doesn't hold back the rows after it, which may then overtake it.
+func publishBatch(ctx context.Context, sender BatchMessageSender, rows []OutboxORM) ([]uint, error) {
+	messages := make([]Message, len(rows))
+	for i := range rows {
+		messages[i] = &rows[i]
+	}
+	err := sender.ProduceMessages(ctx, messages)
+
+	delivered := len(rows)
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		for i := range batchErr.Failures {
+			if i < delivered {
+				delivered = i
+			}
+		}
+	} else if err != nil {
+		delivered = 0
+	}
+
+	ids := make([]uint, delivered)
+	for i := range ids {
+		ids[i] = rows[i].ID
+	}
+	return ids, err
+}
@@ -0,0 +1,221 @@
+package kmanager
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeSender struct {
+	failOn string
+	sent   []string
+}
+
+func (s *fakeSender) ProduceMessage(_ context.Context, message Message) error {
+	if string(message.Value()) == s.failOn {
+		return errors.New("delivery failed")
+	}
+	s.sent = append(s.sent, string(message.Value()))
+	return nil
+}
+
+func TestPublishInOrder(t *testing.T) {
+	rows := []OutboxORM{
+		{ID: 1, KafkaTopic: "orders", KafkaValue: "first"},
+		{ID: 2, KafkaTopic: "orders", KafkaValue: "second"},
+		{ID: 3, KafkaTopic: "orders", KafkaValue: "third"},
+	}
+
+	tests := []struct {
+		name      string
+		failOn    string
+		delivered []uint
+		sent      []string
+		wantErr   bool
+	}{
+		{
+			name:      "All rows are delivered",
+			delivered: []uint{1, 2, 3},
+			sent:      []string{"first", "second", "third"},
+		},
+		{
+			name:      "Failure stops the batch",
+			failOn:    "second",
+			delivered: []uint{1},
+			sent:      []string{"first"},
+			wantErr:   true,
+		},
+		{
+			name:      "Nothing delivered",
+			failOn:    "first",
+			delivered: []uint{},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender := &fakeSender{failOn: tt.failOn}
+			delivered, err := publishInOrder(context.Background(), sender, rows)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TestPublishInOrder(): error\ngot= \t%v\nwant = \t%v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(delivered, tt.delivered) {
+				t.Errorf("TestPublishInOrder(): delivered\ngot= \t%v\nwant = \t%v", delivered, tt.delivered)
+			}
+			if !reflect.DeepEqual(sender.sent, tt.sent) {
+				t.Errorf("TestPublishInOrder(): sent\ngot= \t%v\nwant = \t%v", sender.sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestPublishBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []ProducerOption
+		failTopic string
+		delivered []uint
+		sent      []string
+		wantErr   bool
+	}{
+		{
+			name:      "All rows are delivered",
+			opts:      []ProducerOption{WithOrderedDelivery()},
+			delivered: []uint{1, 2, 3},
+			sent:      []string{"first", "third"},
+		},
+		{
+			name:      "Rows after a permanent failure get through",
+			opts:      []ProducerOption{WithOrderedDelivery()},
+			failTopic: "invoices",
+			delivered: []uint{1},
+			sent:      []string{"first", "third"},
+			wantErr:   true,
+		},
+		{
+			name:      "Unordered producer sends rows one by one",
+			failTopic: "invoices",
+			delivered: []uint{1},
+			sent:      []string{"first"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			if tt.failTopic != "" {
+				broker.FailProduce(tt.failTopic, kafka.NewError(kafka.ErrMsgSizeTooLarge, "too large", false))
+			}
+			producer := NewMessageProducerFromClient(broker.NewProducer(), tt.opts...)
+			rows := []OutboxORM{
+				{ID: 1, KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "first"},
+				{ID: 2, KafkaTopic: "invoices", KafkaKey: "42", KafkaValue: "second"},
+				{ID: 3, KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "third"},
+			}
+			delivered, err := publishInOrder(context.Background(), producer, rows)
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TestPublishBatch(): error\ngot= \t%v\nwant = \t%v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(delivered, tt.delivered) {
+				t.Errorf("TestPublishBatch(): delivered\ngot= \t%v\nwant = \t%v", delivered, tt.delivered)
+			}
+			sent := []string{}
+			for _, msg := range broker.Messages("orders") {
+				sent = append(sent, string(msg.Value))
+			}
+			if !reflect.DeepEqual(sent, tt.sent) {
+				t.Errorf("TestPublishBatch(): sent\ngot= \t%v\nwant = \t%v", sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestOutboxRelayDrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		locked    bool
+		failTopic string
+		deleted   []driver.Value
+		delivered int
+		sent      int
+		wantErr   bool
+	}{
+		{name: "Delivered rows are deleted", locked: true, deleted: []driver.Value{1, 2, 3}, delivered: 3, sent: 3},
+		{name: "Rows from the failure on are kept", locked: true, failTopic: "invoices", deleted: []driver.Value{1}, delivered: 1, sent: 1, wantErr: true},
+		{name: "Another replica drains the outbox", locked: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			if tt.failTopic != "" {
+				broker.FailProduce(tt.failTopic, kafka.NewError(kafka.ErrMsgSizeTooLarge, "too large", false))
+			}
+			db, mock := newMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT pg_try_advisory_xact_lock`).
+				WithArgs(OutboxRelayLockID).
+				WillReturnRows(sqlmock.NewRows([]string{"pg_try_advisory_xact_lock"}).AddRow(tt.locked))
+			if tt.locked {
+				mock.ExpectQuery(`SELECT \* FROM "outbox" ORDER BY id LIMIT 10`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "kafka_topic", "kafka_key", "kafka_value", "kafka_payload", "content_type", "kafka_headers"}).
+						AddRow(1, "orders", "42", "placed", nil, "", nil).
+						AddRow(2, "invoices", "42", "issued", nil, "", nil).
+						AddRow(3, "orders", "42", "paid", nil, "", nil))
+				mock.ExpectExec(`DELETE FROM "outbox"`).
+					WithArgs(tt.deleted...).
+					WillReturnResult(sqlmock.NewResult(0, int64(len(tt.deleted))))
+			}
+			mock.ExpectCommit()
+
+			relay := NewOutboxRelay(db, NewMessageProducerFromClient(broker.NewProducer()), 10, time.Second)
+			delivered, err := relay.Drain(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("TestOutboxRelayDrain(): Drain error\ngot= \t%v\nwant = \t%v", err, tt.wantErr)
+			}
+			if delivered != tt.delivered {
+				t.Errorf("TestOutboxRelayDrain(): delivered\ngot= \t%v\nwant = \t%v", delivered, tt.delivered)
+			}
+			if sent := len(broker.Messages("orders")) + len(broker.Messages("invoices")); sent != tt.sent {
+				t.Errorf("TestOutboxRelayDrain(): sent\ngot= \t%v\nwant = \t%v", sent, tt.sent)
+			}
+			if err = mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestNewOutboxRelay(t *testing.T) {
+	tests := []struct {
+		name         string
+		batchSize    int
+		pollInterval time.Duration
+		wantSize     int
+		wantInterval time.Duration
+	}{
+		{name: "Given values", batchSize: 10, pollInterval: time.Minute, wantSize: 10, wantInterval: time.Minute},
+		{name: "Zero values", wantSize: DefaultOutboxBatchSize, wantInterval: DefaultOutboxPollInterval},
+		{name: "Negative values", batchSize: -1, pollInterval: -time.Second, wantSize: DefaultOutboxBatchSize, wantInterval: DefaultOutboxPollInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := NewOutboxRelay(nil, nil, tt.batchSize, tt.pollInterval)
+			if relay.batchSize != tt.wantSize {
+				t.Errorf("TestNewOutboxRelay(): batchSize\ngot= \t%v\nwant = \t%v", relay.batchSize, tt.wantSize)
+			}
+			if relay.pollInterval != tt.wantInterval {
+				t.Errorf("TestNewOutboxRelay(): pollInterval\ngot= \t%v\nwant = \t%v", relay.pollInterval, tt.wantInterval)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var (
+	errConsumerStopped = errors.New("consumer stopped before the message was processed")
+)
+
+type RetryPolicy interface {
+	// NextBackoff is called after a failed attempt, attempt counts from 1.
+	// It returns how long to wait before the next attempt, false gives up.
+	NextBackoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+// PermanentError marks handler failures which retrying cannot fix,
+// such messages are sent to the dead letter queue straight away
+type PermanentError struct {
+	Err error
+}
+
+func NewPermanentError(err error) error {
+	return &PermanentError{Err: err}
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func IsPermanent(err error) bool {
+	var permanentErr *PermanentError
+	return errors.As(err, &permanentErr)
+}
+
+type ExponentialBackoff struct {
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter randomizes every wait by up to the given fraction, between 0 and 1
+	Jitter         float64
+	MaxElapsedTime time.Duration
+	// IsRetryable classifies errors, nil treats every non permanent error as retryable
+	IsRetryable func(err error) bool
+}
+
+// DefaultRetryPolicy retries 4 times waiting 2, 4, 8 and 16 seconds
+func DefaultRetryPolicy() *ExponentialBackoff {
+	return &ExponentialBackoff{
+		MaxAttempts:     5,
+		InitialInterval: 2 * time.Second,
+		MaxInterval:     16 * time.Second,
+		Multiplier:      2,
+	}
+}
+
+func NoRetries() *ExponentialBackoff {
+	return &ExponentialBackoff{MaxAttempts: 1}
+}
+
+func (b *ExponentialBackoff) NextBackoff(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if IsPermanent(err) {
+		return 0, false
+	}
+	if b.IsRetryable != nil && !b.IsRetryable(err) {
+		return 0, false
+	}
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(b.InitialInterval) * math.Pow(multiplier, float64(attempt-1))
+	if b.MaxInterval > 0 && backoff > float64(b.MaxInterval) {
+		backoff = float64(b.MaxInterval)
+	}
+	if b.Jitter > 0 {
+		backoff += backoff * b.Jitter * (2*rand.Float64() - 1)
+	}
+
+	wait := time.Duration(backoff)
+	if b.MaxElapsedTime > 0 && elapsed+wait > b.MaxElapsedTime {
+		return 0, false
+	}
+	return wait, true
+}
+
+// sleep waits for the given duration unless the consumer is closed or its handlers were cancelled
+func sleep(ctx context.Context, stop <-chan bool, wait time.Duration) error {
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-stop:
+		return errConsumerStopped
+	case <-ctx.Done():
+		return errConsumerStopped
+	}
+}
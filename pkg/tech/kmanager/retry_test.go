@@ -0,0 +1,96 @@
+package kmanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	failure := errors.New("database is down")
+
+	tests := []struct {
+		name    string
+		policy  *ExponentialBackoff
+		attempt int
+		elapsed time.Duration
+		err     error
+		wait    time.Duration
+		retry   bool
+	}{
+		{
+			name:    "First retry of default policy",
+			policy:  DefaultRetryPolicy(),
+			attempt: 1,
+			err:     failure,
+			wait:    2 * time.Second,
+			retry:   true,
+		},
+		{
+			name:    "Last retry of default policy",
+			policy:  DefaultRetryPolicy(),
+			attempt: 4,
+			err:     failure,
+			wait:    16 * time.Second,
+			retry:   true,
+		},
+		{
+			name:    "Attempts are exhausted",
+			policy:  DefaultRetryPolicy(),
+			attempt: 5,
+			err:     failure,
+		},
+		{
+			name:    "Permanent errors are not retried",
+			policy:  DefaultRetryPolicy(),
+			attempt: 1,
+			err:     NewPermanentError(failure),
+		},
+		{
+			name: "Wait is capped by max interval",
+			policy: &ExponentialBackoff{
+				InitialInterval: time.Second,
+				MaxInterval:     5 * time.Second,
+				Multiplier:      10,
+			},
+			attempt: 3,
+			err:     failure,
+			wait:    5 * time.Second,
+			retry:   true,
+		},
+		{
+			name: "Max elapsed time is exceeded",
+			policy: &ExponentialBackoff{
+				InitialInterval: time.Second,
+				MaxElapsedTime:  time.Minute,
+			},
+			attempt: 2,
+			elapsed: 59*time.Second + 500*time.Millisecond,
+			err:     failure,
+		},
+		{
+			name: "Error is classified as not retryable",
+			policy: &ExponentialBackoff{
+				InitialInterval: time.Second,
+				IsRetryable: func(err error) bool {
+					return !errors.Is(err, failure)
+				},
+			},
+			attempt: 1,
+			err:     failure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, retry := tt.policy.NextBackoff(tt.attempt, tt.elapsed, tt.err)
+
+			if retry != tt.retry {
+				t.Errorf("TestExponentialBackoff(): retry\ngot= \t%v\nwant = \t%v", retry, tt.retry)
+			}
+			if wait != tt.wait {
+				t.Errorf("TestExponentialBackoff(): wait\ngot= \t%v\nwant = \t%v", wait, tt.wait)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderRetryNotBefore         = "kmanager-retry-not-before"
+	HeaderRetryOriginalTopic     = "kmanager-retry-original-topic"
+	HeaderRetryOriginalPartition = "kmanager-retry-original-partition"
+	HeaderRetryOriginalOffset    = "kmanager-retry-original-offset"
+	HeaderRetryAttempts          = "kmanager-retry-attempts"
+)
+
+var (
+	DefaultRetryTiers = []RetryTier{
+		{Delay: 5 * time.Second},
+		{Delay: time.Minute},
+		{Delay: 10 * time.Minute},
+	}
+
+	ErrMissingRetryTopics = errors.New("retry tier topics don't exist")
+
+	errRetryNotDue = errors.New("retry message is not due yet")
+	// retryTopicsTimeoutMs bounds the metadata request checking retry tier topics
+	retryTopicsTimeoutMs = 10_000
+)
+
+// RetryTier is a topic holding failed messages until Delay has passed,
+// each consumed topic has its own `<topic>.retry.<delay>` tier topic
+type RetryTier struct {
+	Delay time.Duration
+}
+
+func (t RetryTier) TopicFor(topic string) string {
+	return fmt.Sprintf("%v.retry.%v", topic, formatDelay(t.Delay))
+}
+
+func RetryTopicNames(topicNames []string, tiers []RetryTier) []string {
+	result := make([]string, 0, len(topicNames)*len(tiers))
+	for _, topic := range topicNames {
+		for _, tier := range tiers {
+			result = append(result, tier.TopicFor(topic))
+		}
+	}
+	return result
+}
+
+// checkRetryTopics fails with ErrMissingRetryTopics when tier topics of the consumer weren't
+// created, see CreateTopics and TopicAdmin, rather than retrying into topics nobody reads
+func (mc *MessageConsumer) checkRetryTopics() error {
+	retryTopics := RetryTopicNames(mc.topicNames, mc.retryTiers)
+	if len(retryTopics) == 0 {
+		return nil
+	}
+	metadata, err := mc.consumer.GetMetadata(nil, true, retryTopicsTimeoutMs)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, topic := range retryTopics {
+		if _, ok := metadata.Topics[topic]; !ok {
+			missing = append(missing, topic)
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("%w: %v", ErrMissingRetryTopics, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func formatDelay(delay time.Duration) string {
+	switch {
+	case delay%time.Hour == 0:
+		return fmt.Sprintf("%vh", int64(delay/time.Hour))
+	case delay%time.Minute == 0:
+		return fmt.Sprintf("%vm", int64(delay/time.Minute))
+	case delay%time.Second == 0:
+		return fmt.Sprintf("%vs", int64(delay/time.Second))
+	default:
+		return fmt.Sprintf("%vms", delay.Milliseconds())
+	}
+}
+
+type RetryMessage struct {
+	topic   string
+	key     []byte
+	value   []byte
+	headers []kafka.Header
+}
+
+func newRetryMessage(msg *kafka.Message, tier RetryTier, attempts int) *RetryMessage {
+	headers := make([]kafka.Header, 0, len(msg.Headers)+5)
+	for _, h := range msg.Headers {
+		if !strings.HasPrefix(h.Key, "kmanager-retry-") {
+			headers = append(headers, h)
+		}
+	}
+	notBefore := time.Now().Add(tier.Delay).UnixMilli()
+	headers = append(headers,
+		kafka.Header{Key: HeaderRetryNotBefore, Value: []byte(strconv.FormatInt(notBefore, 10))},
+		kafka.Header{Key: HeaderRetryOriginalTopic, Value: []byte(*msg.TopicPartition.Topic)},
+		kafka.Header{Key: HeaderRetryOriginalPartition, Value: []byte(strconv.Itoa(int(msg.TopicPartition.Partition)))},
+		kafka.Header{Key: HeaderRetryOriginalOffset, Value: []byte(msg.TopicPartition.Offset.String())},
+		kafka.Header{Key: HeaderRetryAttempts, Value: []byte(strconv.Itoa(attempts))},
+	)
+
+	return &RetryMessage{
+		topic:   tier.TopicFor(*msg.TopicPartition.Topic),
+		key:     msg.Key,
+		value:   msg.Value,
+		headers: headers,
+	}
+}
+
+func (m *RetryMessage) Key() []byte {
+	return m.key
+}
+
+func (m *RetryMessage) Value() []byte {
+	return m.value
+}
+
+func (m *RetryMessage) Topic() *string {
+	return &m.topic
+}
+
+func (m *RetryMessage) Headers() []kafka.Header {
+	return m.headers
+}
+
+// retryState describes how far a message got through the retry tiers
+type retryState struct {
+	// tier is the index of the tier a failed message is forwarded to
+	tier      int
+	attempts  int
+	partition kafka.TopicPartition
+}
+
+func (mc *MessageConsumer) retryStateOf(msg *kafka.Message) (*retryState, error) {
+	tier, ok := mc.retryTopics[*msg.TopicPartition.Topic]
+	if !ok {
+		return &retryState{partition: msg.TopicPartition}, nil
+	}
+
+	state := &retryState{tier: tier + 1, partition: msg.TopicPartition}
+	if topic, ok := HeaderValue(msg, HeaderRetryOriginalTopic); ok {
+		state.partition.Topic = &topic
+	}
+	if partition, ok := HeaderValue(msg, HeaderRetryOriginalPartition); ok {
+		if id, err := strconv.ParseInt(partition, 10, 32); err == nil {
+			state.partition.Partition = int32(id)
+		}
+	}
+	if offset, ok := HeaderValue(msg, HeaderRetryOriginalOffset); ok {
+		if o, err := kafka.NewOffset(offset); err == nil {
+			state.partition.Offset = o
+		}
+	}
+	if attempts, ok := HeaderValue(msg, HeaderRetryAttempts); ok {
+		state.attempts, _ = strconv.Atoi(attempts)
+	}
+	if notBefore, ok := HeaderValue(msg, HeaderRetryNotBefore); ok {
+		if millis, err := strconv.ParseInt(notBefore, 10, 64); err == nil {
+			if due := time.UnixMilli(millis); time.Now().Before(due) {
+				return nil, mc.deferRetry(msg, due)
+			}
+		}
+	}
+	return state, nil
+}
+
+// restore presents the message to handlers as if it came from its original topic
+func (s *retryState) restore(msg *kafka.Message) *kafka.Message {
+	if s.tier == 0 {
+		return msg
+	}
+	restored := *msg
+	restored.TopicPartition = s.partition
+	// the partition it was read from is kept for committing
+	restored.Opaque = msg.TopicPartition
+	return &restored
+}
+
+// consumedPartition is where msg was read from, which differs from its partition once restored
+func consumedPartition(msg *kafka.Message) kafka.TopicPartition {
+	if tp, ok := msg.Opaque.(kafka.TopicPartition); ok {
+		return tp
+	}
+	return msg.TopicPartition
+}
+
+// deferRetry pauses the retry partition and rewinds it to msg, so other
+// partitions keep flowing while the message waits to become due
+func (mc *MessageConsumer) deferRetry(msg *kafka.Message, due time.Time) error {
+	tp := msg.TopicPartition
+	if err := mc.consumer.Pause([]kafka.TopicPartition{tp}); err != nil {
+		return err
+	}
+	if err := mc.consumer.Seek(tp, 0); err != nil {
+		return err
+	}
+	mc.pausedRetries[partitionKey(tp)] = pausedRetry{partition: tp, due: due}
+	return errRetryNotDue
+}
+
+type pausedRetry struct {
+	partition kafka.TopicPartition
+	due       time.Time
+}
+
+func (mc *MessageConsumer) isPaused(tp kafka.TopicPartition) bool {
+	_, ok := mc.pausedRetries[partitionKey(tp)]
+	return ok
+}
+
+func (mc *MessageConsumer) resumeDueRetries(ctx context.Context) {
+	now := time.Now()
+	for key, paused := range mc.pausedRetries {
+		if now.Before(paused.due) {
+			continue
+		}
+		if mc.pool != nil && len(mc.pool.backlog[key]) != 0 {
+			// drainBacklog resumes it once the workers caught up
+			delete(mc.pausedRetries, key)
+			continue
+		}
+		if err := mc.consumer.Resume([]kafka.TopicPartition{paused.partition}); err != nil {
+			log := ctxlogrus.Extract(ctx)
+			log.Warnf("couldn't resume retry partition %v", err)
+			continue
+		}
+		delete(mc.pausedRetries, key)
+	}
+}
+
+func partitionKey(tp kafka.TopicPartition) string {
+	return fmt.Sprintf("%v/%v", *tp.Topic, tp.Partition)
+}
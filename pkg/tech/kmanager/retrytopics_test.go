@@ -0,0 +1,175 @@
+package kmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTierTopicFor(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  string
+	}{
+		{delay: 2 * time.Hour, want: "orders.retry.2h"},
+		{delay: time.Minute, want: "orders.retry.1m"},
+		{delay: 5 * time.Second, want: "orders.retry.5s"},
+		{delay: 1500 * time.Millisecond, want: "orders.retry.1500ms"},
+	}
+	for _, tt := range tests {
+		if got := (RetryTier{Delay: tt.delay}).TopicFor("orders"); got != tt.want {
+			t.Errorf("TestRetryTierTopicFor(): TopicFor\ngot= \t%v\nwant = \t%v", got, tt.want)
+		}
+	}
+}
+
+func TestDeferRetry(t *testing.T) {
+	tier := RetryTier{Delay: 100 * time.Millisecond}
+	orders := "orders"
+	original := &kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &orders, Partition: 0, Offset: 7},
+		Key:            []byte("42"),
+		Value:          []byte("placed"),
+		Headers:        []kafka.Header{{Key: HeaderRetryAttempts, Value: []byte("9")}},
+	}
+
+	broker := kafkatest.NewBroker()
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	if err := producer.ProduceMessage(context.Background(), newRetryMessage(original, tier, 2)); err != nil {
+		t.Fatal(err)
+	}
+	consumer := broker.NewConsumer("billing")
+	mc := NewMessageConsumerFromClients(nil, nil, consumer, producer, "billing", []string{orders}, WithRetryTopics(tier))
+	if err := consumer.SubscribeTopics(RetryTopicNames(mc.topicNames, mc.retryTiers), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := consumer.ReadMessage(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mc.retryStateOf(msg); err != errRetryNotDue {
+		t.Fatalf("TestDeferRetry(): retryStateOf before due\ngot= \t%v\nwant = \t%v", err, errRetryNotDue)
+	}
+	if !mc.isPaused(msg.TopicPartition) {
+		t.Fatalf("TestDeferRetry(): isPaused\ngot= \t%v\nwant = \t%v", false, true)
+	}
+	if _, err = consumer.ReadMessage(10 * time.Millisecond); err == nil {
+		t.Fatalf("TestDeferRetry(): ReadMessage of a paused partition\ngot= \t%v\nwant = \t%v", nil, "timeout")
+	}
+
+	mc.resumeDueRetries(context.Background())
+	if !mc.isPaused(msg.TopicPartition) {
+		t.Fatalf("TestDeferRetry(): resumed before due\ngot= \t%v\nwant = \t%v", true, false)
+	}
+	time.Sleep(tier.Delay)
+	mc.resumeDueRetries(context.Background())
+	if mc.isPaused(msg.TopicPartition) {
+		t.Fatalf("TestDeferRetry(): resumed once due\ngot= \t%v\nwant = \t%v", false, true)
+	}
+
+	again, err := consumer.ReadMessage(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.TopicPartition.Offset != msg.TopicPartition.Offset {
+		t.Fatalf("TestDeferRetry(): offset read after seeking back\ngot= \t%v\nwant = \t%v", again.TopicPartition.Offset, msg.TopicPartition.Offset)
+	}
+	state, err := mc.retryStateOf(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := state.restore(again)
+	if *restored.TopicPartition.Topic != orders || restored.TopicPartition.Offset != 7 {
+		t.Errorf("TestDeferRetry(): restored partition\ngot= \t%v\nwant = \t%v", restored.TopicPartition, original.TopicPartition)
+	}
+	if consumedPartition(restored).Offset != again.TopicPartition.Offset {
+		t.Errorf("TestDeferRetry(): consumedPartition\ngot= \t%v\nwant = \t%v", consumedPartition(restored), again.TopicPartition)
+	}
+	if state.tier != 1 || state.attempts != 2 {
+		t.Errorf("TestDeferRetry(): tier and attempts\ngot= \t%v %v\nwant = \t%v %v", state.tier, state.attempts, 1, 2)
+	}
+}
+
+func TestRetryTiers(t *testing.T) {
+	tiers := []RetryTier{{Delay: 10 * time.Millisecond}, {Delay: 20 * time.Millisecond}}
+
+	broker := kafkatest.NewBroker()
+	for _, topic := range RetryTopicNames([]string{"orders"}, tiers) {
+		broker.CreateTopic(topic, 1)
+	}
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int32
+	handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		atomic.AddInt32(&calls, 1)
+		if *msg.TopicPartition.Topic != "orders" {
+			t.Errorf("TestRetryTiers(): handled topic\ngot= \t%v\nwant = \t%v", *msg.TopicPartition.Topic, "orders")
+		}
+		return errors.New("handler failed")
+	}
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"}, WithRetryTopics(tiers...))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mc.Start(context.Background(), handler)
+	}()
+	waitFor(t, func() bool {
+		return len(broker.Messages(DeadLetterQueueTopic)) == 1 &&
+			broker.Committed("billing", tiers[1].TopicFor("orders"), 0) == 1
+	})
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != 3 {
+		t.Errorf("TestRetryTiers(): calls\ngot= \t%v\nwant = \t%v", calls, 3)
+	}
+	for i, tier := range tiers {
+		messages := broker.Messages(tier.TopicFor("orders"))
+		if len(messages) != 1 {
+			t.Fatalf("TestRetryTiers(): messages of tier %v\ngot= \t%v\nwant = \t%v", i, len(messages), 1)
+		}
+		attempts, _ := HeaderValue(messages[0], HeaderRetryAttempts)
+		if want := strconv.Itoa(i + 1); attempts != want {
+			t.Errorf("TestRetryTiers(): attempts of tier %v\ngot= \t%v\nwant = \t%v", i, attempts, want)
+		}
+	}
+	envelope := &DLQEnvelope{}
+	if err := json.Unmarshal(broker.Messages(DeadLetterQueueTopic)[0].Value, envelope); err != nil {
+		t.Fatal(err)
+	}
+	if envelope.OriginalTopic != "orders" || envelope.Attempts != 3 {
+		t.Errorf("TestRetryTiers(): dead letter\ngot= \t%v %v\nwant = \t%v %v", envelope.OriginalTopic, envelope.Attempts, "orders", 3)
+	}
+}
+
+func TestMissingRetryTopics(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	tiers := []RetryTier{{Delay: time.Second}, {Delay: time.Minute}}
+	broker.CreateTopic(tiers[0].TopicFor("orders"), 1)
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"}, WithRetryTopics(tiers...))
+
+	err := mc.Start(context.Background(), func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		return nil
+	})
+	if !errors.Is(err, ErrMissingRetryTopics) || !strings.Contains(err.Error(), "orders.retry.1m") {
+		t.Errorf("TestMissingRetryTopics(): Start\ngot= \t%v\nwant = \t%v", err, ErrMissingRetryTopics)
+	}
+}
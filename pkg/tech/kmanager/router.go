@@ -0,0 +1,145 @@
+package kmanager
+
+import (
+	"context"
+	"fmt"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+)
+
+type EventHandler func(ctx context.Context, arguments *messaging.ContextualArguments,
+	db *gorm.DB, event interface{}) error
+
+// TopicRouter dispatches messages to handlers registered per topic,
+// or per topic and event `type` in which case events are decoded from templates first
+type TopicRouter struct {
+	routes map[string]*topicRoute
+	topics []string
+}
+
+type topicRoute struct {
+	handler   TopicHandler
+	templates map[string]messaging.EventsTemplate
+	events    map[string]EventHandler
+}
+
+func NewTopicRouter() *TopicRouter {
+	return &TopicRouter{routes: map[string]*topicRoute{}}
+}
+
+// Handle registers a handler receiving every raw message of the topic
+func (r *TopicRouter) Handle(topic string, handler TopicHandler) *TopicRouter {
+	r.route(topic).handler = handler
+	return r
+}
+
+func (r *TopicRouter) HandleEvent(topic, eventType string, template messaging.EventTemplate, handler EventHandler) *TopicRouter {
+	return r.HandleEvents(topic, eventType, messaging.EventsTemplate{
+		Template: template.Template,
+		Flatten: func(data interface{}) []interface{} {
+			return []interface{}{data}
+		},
+	}, handler)
+}
+
+// HandleTyped registers a handler receiving events of eventType decoded into *T
+func HandleTyped[T any](r *TopicRouter, topic, eventType string,
+	handler func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, event *T) error) *TopicRouter {
+	return r.HandleEvent(topic, eventType, messaging.TemplateOf[T](),
+		func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, event interface{}) error {
+			typed, ok := event.(*T)
+			if !ok {
+				return NewPermanentError(fmt.Errorf("event of type %v decoded into %T instead of %T", eventType, event, typed))
+			}
+			return handler(ctx, arguments, db, typed)
+		})
+}
+
+// HandleEvents registers a handler called for each event the decoded message is flattened into
+func (r *TopicRouter) HandleEvents(topic, eventType string, template messaging.EventsTemplate, handler EventHandler) *TopicRouter {
+	route := r.route(topic)
+	route.templates[eventType] = template
+	route.events[eventType] = handler
+	return r
+}
+
+func (r *TopicRouter) route(topic string) *topicRoute {
+	route, ok := r.routes[topic]
+	if !ok {
+		route = &topicRoute{
+			templates: map[string]messaging.EventsTemplate{},
+			events:    map[string]EventHandler{},
+		}
+		r.routes[topic] = route
+		r.topics = append(r.topics, topic)
+	}
+	return route
+}
+
+func (r *TopicRouter) Topics() []string {
+	return r.topics
+}
+
+func (r *TopicRouter) HandleMessage(ctx context.Context, arguments *messaging.ContextualArguments,
+	db *gorm.DB, msg *kafka.Message) error {
+	topic := *msg.TopicPartition.Topic
+	route, ok := r.routes[topic]
+	if !ok {
+		// retrying won't register a route
+		return NewPermanentError(NewKafkaErrUnknownTopic(topic))
+	}
+	if route.handler != nil {
+		return route.handler(ctx, arguments, db, msg)
+	}
+
+	data, contentType, eventType, err := eventPayload(msg)
+	if err != nil {
+		return NewPermanentError(NewKafkaErrEventParse(msg, topic, err))
+	}
+	template, ok := route.templates[eventType]
+	if !ok {
+		return NewPermanentError(NewKafkaErrUnknownEventType(topic, eventType))
+	}
+
+	events, err := messaging.NewEventsFromPayload(ctx, data, contentType, eventType, map[string]messaging.EventsTemplate{
+		eventType: template,
+	})
+	if err != nil {
+		return NewPermanentError(NewKafkaErrEventParse(msg, topic, err))
+	}
+	for _, event := range events {
+		if err = route.events[eventType](ctx, arguments, db, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peekEventType reads the event type header of binary events, the ce_type header of binary
+// CloudEvents or the `type` field of JSON events
+func peekEventType(msg *kafka.Message, contentType string) (string, error) {
+	if eventType, ok := HeaderValue(msg, HeaderEventType); ok {
+		return eventType, nil
+	}
+	if eventType, ok := HeaderValue(msg, cloudEventsHeaderPrefix+"type"); ok {
+		return eventType, nil
+	}
+	codec, err := messaging.CodecFor(contentType)
+	if err != nil {
+		return "", err
+	}
+	head := &struct {
+		Type string `json:"type"`
+	}{}
+	if err = codec.Decode(msg.Value, head); err != nil {
+		return "", err
+	}
+	return head.Type, nil
+}
+
+// StartRouter subscribes to the topics registered in the router and consumes them
+func (mc *MessageConsumer) StartRouter(ctx context.Context, router *TopicRouter) error {
+	mc.subscribeTo(router.Topics())
+	return mc.Start(ctx, router.HandleMessage)
+}
@@ -0,0 +1,141 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"reflect"
+	"testing"
+)
+
+type orderPlaced struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type orderCancelled struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+func TestTopicRouter(t *testing.T) {
+	var handled []interface{}
+	router := NewTopicRouter().
+		Handle("audit", func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+			handled = append(handled, string(msg.Value))
+			return nil
+		}).
+		HandleEvent("orders", "OrderPlaced", messaging.EventTemplate{Template: &orderPlaced{}},
+			func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, event interface{}) error {
+				handled = append(handled, event)
+				return nil
+			})
+	HandleTyped(router, "orders", "OrderCancelled",
+		func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, event *orderCancelled) error {
+			handled = append(handled, event)
+			return nil
+		})
+
+	tests := []struct {
+		name      string
+		topic     string
+		value     string
+		headers   []kafka.Header
+		handled   []interface{}
+		permanent bool
+	}{
+		{
+			name:    "Raw handler of the topic",
+			topic:   "audit",
+			value:   "login",
+			handled: []interface{}{"login"},
+		},
+		{
+			name:    "Event handler",
+			topic:   "orders",
+			value:   `{"type":"OrderPlaced","id":"42"}`,
+			handled: []interface{}{&orderPlaced{Type: "OrderPlaced", ID: "42"}},
+		},
+		{
+			name:    "Typed handler",
+			topic:   "orders",
+			value:   `{"type":"OrderCancelled","id":"42","reason":"late"}`,
+			handled: []interface{}{&orderCancelled{Type: "OrderCancelled", ID: "42", Reason: "late"}},
+		},
+		{
+			name:    "Event type header",
+			topic:   "orders",
+			value:   `{"id":"42"}`,
+			headers: []kafka.Header{{Key: HeaderEventType, Value: []byte("OrderPlaced")}},
+			handled: []interface{}{&orderPlaced{Type: "OrderPlaced", ID: "42"}},
+		},
+		{
+			name:  "Binary cloud event",
+			topic: "orders",
+			value: `{"id":"42"}`,
+			headers: []kafka.Header{
+				{Key: HeaderContentType, Value: []byte(messaging.JSONContentType)},
+				{Key: "ce_specversion", Value: []byte(messaging.CloudEventsSpecVersion)},
+				{Key: "ce_type", Value: []byte("OrderPlaced")},
+			},
+			handled: []interface{}{&orderPlaced{Type: "OrderPlaced", ID: "42"}},
+		},
+		{
+			name:    "Structured cloud event",
+			topic:   "orders",
+			value:   `{"specversion":"1.0","id":"1","source":"billing","type":"OrderCancelled","data":{"id":"42","reason":"late"}}`,
+			headers: []kafka.Header{{Key: HeaderContentType, Value: []byte(messaging.CloudEventsContentType)}},
+			handled: []interface{}{&orderCancelled{Type: "OrderCancelled", ID: "42", Reason: "late"}},
+		},
+		{
+			name:      "Unknown event type",
+			topic:     "orders",
+			value:     `{"type":"OrderShipped","id":"42"}`,
+			permanent: true,
+		},
+		{
+			name:      "Unknown topic",
+			topic:     "invoices",
+			value:     `{"type":"InvoiceIssued"}`,
+			permanent: true,
+		},
+		{
+			name:      "Unparsable event",
+			topic:     "orders",
+			value:     `{"type":`,
+			permanent: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled = nil
+			topic := tt.topic
+			msg := &kafka.Message{
+				TopicPartition: kafka.TopicPartition{Topic: &topic},
+				Value:          []byte(tt.value),
+				Headers:        tt.headers,
+			}
+
+			err := router.HandleMessage(context.Background(), nil, nil, msg)
+			if (err != nil) != tt.permanent || IsPermanent(err) != tt.permanent {
+				t.Fatalf("TestTopicRouter(): HandleMessage error\ngot= \t%v\nwant = \t%v", err, tt.permanent)
+			}
+			if !reflect.DeepEqual(handled, tt.handled) {
+				t.Errorf("TestTopicRouter(): handled\ngot= \t%v\nwant = \t%v", handled, tt.handled)
+			}
+		})
+	}
+
+	want := []string{"audit", "orders"}
+	if !reflect.DeepEqual(router.Topics(), want) {
+		t.Errorf("TestTopicRouter(): Topics\ngot= \t%v\nwant = \t%v", router.Topics(), want)
+	}
+}
+
+func TestNewKafkaErrUnknownTopic(t *testing.T) {
+	if err := NewKafkaErrUnknownTopic("orders"); IsPermanent(err) {
+		t.Errorf("TestNewKafkaErrUnknownTopic(): IsPermanent\ngot= \t%v\nwant = \t%v", true, false)
+	}
+}
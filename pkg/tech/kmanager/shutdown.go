@@ -0,0 +1,106 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	DefaultDrainTimeout = 30 * time.Second
+
+	ErrDrainTimeout    = errors.New("consumer did not drain in flight messages in time")
+	ErrConsumerStarted = errors.New("consumer was already started")
+	ErrConsumerClosed  = errors.New("consumer was closed")
+)
+
+// WithDrainTimeout bounds how long in flight messages may take once the consumer stops,
+// afterwards the context handed to handlers is cancelled
+func WithDrainTimeout(timeout time.Duration) ConsumerOption {
+	return func(mc *MessageConsumer) {
+		mc.drainTimeout = timeout
+	}
+}
+
+// Close stops the consumer, waits for in flight messages to drain and releases kafka clients.
+// ErrDrainTimeout is returned when messages had to be abandoned.
+func (mc *MessageConsumer) Close() error {
+	mc.requestStop()
+
+	var err error
+	// a consumer closed before it started is marked started so it never runs
+	if !atomic.CompareAndSwapInt32(&mc.started, 0, 1) {
+		<-mc.done
+		if atomic.LoadInt32(&mc.drainTimedOut) == 1 {
+			err = ErrDrainTimeout
+		}
+	}
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), mc.drainTimeout)
+	defer cancel()
+	_ = mc.dlqProducer.Flush(flushCtx)
+	mc.dlqProducer.Close()
+	if closeErr := mc.consumer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (mc *MessageConsumer) isStopped() bool {
+	select {
+	case <-mc.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (mc *MessageConsumer) requestStop() {
+	mc.stopOnce.Do(func() {
+		close(mc.stop)
+	})
+}
+
+// superviseShutdown stops the consumer once ctx is done and cancels handlers
+// which are still running when the drain timeout passes
+func (mc *MessageConsumer) superviseShutdown(ctx context.Context, cancelHandlers context.CancelFunc) {
+	select {
+	case <-ctx.Done():
+		mc.requestStop()
+	case <-mc.stop:
+	case <-mc.done:
+		return
+	}
+
+	timer := time.NewTimer(mc.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-mc.done:
+	case <-timer.C:
+		atomic.StoreInt32(&mc.drainTimedOut, 1)
+		cancelHandlers()
+	}
+}
+
+// detachedContext keeps the values of its parent without being cancelled along with it,
+// so handlers may finish their work while the consumer drains
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
@@ -0,0 +1,158 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/Cobalt0s/creme-brulee/pkg/tech/kmanager/kafkatest"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConsumerShutdown(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []ConsumerOption
+		handling  time.Duration
+		close     bool
+		err       error
+		committed kafka.Offset
+	}{
+		{
+			name:      "Close drains in flight messages",
+			handling:  50 * time.Millisecond,
+			close:     true,
+			committed: 1,
+		},
+		{
+			name:      "Cancelled context drains in flight messages",
+			handling:  50 * time.Millisecond,
+			committed: 1,
+		},
+		{
+			name:      "Close abandons messages after the drain timeout",
+			opts:      []ConsumerOption{WithDrainTimeout(20 * time.Millisecond)},
+			handling:  time.Minute,
+			close:     true,
+			err:       ErrDrainTimeout,
+			committed: kafka.OffsetInvalid,
+		},
+		{
+			name:      "Cancelled context abandons messages after the drain timeout",
+			opts:      []ConsumerOption{WithDrainTimeout(20 * time.Millisecond)},
+			handling:  time.Minute,
+			err:       ErrDrainTimeout,
+			committed: kafka.OffsetInvalid,
+		},
+		{
+			name:      "Workers are drained",
+			opts:      []ConsumerOption{WithConcurrency(2)},
+			handling:  50 * time.Millisecond,
+			close:     true,
+			committed: 1,
+		},
+		{
+			name:      "Workers are abandoned after the drain timeout",
+			opts:      []ConsumerOption{WithConcurrency(2), WithDrainTimeout(20 * time.Millisecond)},
+			handling:  time.Minute,
+			err:       ErrDrainTimeout,
+			committed: kafka.OffsetInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := kafkatest.NewBroker()
+			producer := NewMessageProducerFromClient(broker.NewProducer())
+			if err := producer.ProduceMessage(context.Background(), &OutboxORM{KafkaTopic: "orders", KafkaKey: "42", KafkaValue: "placed"}); err != nil {
+				t.Fatal(err)
+			}
+
+			started := make(chan bool)
+			handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+				close(started)
+				select {
+				case <-time.After(tt.handling):
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			opts := append([]ConsumerOption{WithRetryPolicy(NoRetries())}, tt.opts...)
+			mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"}, opts...)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := make(chan error, 1)
+			go func() {
+				errs <- mc.Start(ctx, handler)
+			}()
+			<-started
+
+			var err error
+			if tt.close {
+				err = mc.Close()
+			} else {
+				cancel()
+				err = <-errs
+			}
+			if err != tt.err {
+				t.Fatalf("TestConsumerShutdown(): shutdown error\ngot= \t%v\nwant = \t%v", err, tt.err)
+			}
+			if tt.close {
+				if err = <-errs; err != tt.err {
+					t.Fatalf("TestConsumerShutdown(): Start\ngot= \t%v\nwant = \t%v", err, tt.err)
+				}
+			}
+			if offset := broker.Committed("billing", "orders", 0); offset != tt.committed {
+				t.Errorf("TestConsumerShutdown(): committed\ngot= \t%v\nwant = \t%v", offset, tt.committed)
+			}
+			if deadLetters := len(broker.Messages(DeadLetterQueueTopic)); deadLetters != 0 {
+				t.Errorf("TestConsumerShutdown(): dead letters\ngot= \t%v\nwant = \t%v", deadLetters, 0)
+			}
+		})
+	}
+}
+
+func TestConsumerStartTwice(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"})
+	handler := func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		return nil
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mc.Start(context.Background(), handler)
+	}()
+	waitFor(t, func() bool {
+		return atomic.LoadInt32(&mc.started) == 1
+	})
+	if err := mc.Start(context.Background(), handler); err != ErrConsumerStarted {
+		t.Errorf("TestConsumerStartTwice(): second Start\ngot= \t%v\nwant = \t%v", err, ErrConsumerStarted)
+	}
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerClosedBeforeStart(t *testing.T) {
+	broker := kafkatest.NewBroker()
+	producer := NewMessageProducerFromClient(broker.NewProducer())
+	mc := NewMessageConsumerFromClients(nil, nil, broker.NewConsumer("billing"), producer, "billing", []string{"orders"})
+
+	if err := mc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	err := mc.Start(context.Background(), func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		return nil
+	})
+	if err != ErrConsumerClosed {
+		t.Errorf("TestConsumerClosedBeforeStart(): Start\ngot= \t%v\nwant = \t%v", err, ErrConsumerClosed)
+	}
+}
@@ -7,11 +7,91 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Cobalt0s/creme-brulee/pkg/stateful/logging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus/ctxlogrus"
+	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 	"strconv"
 )
 
+var (
+	// Propagator carries traceparent, tracestate and baggage in kafka headers
+	Propagator propagation.TextMapPropagator = propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	)
+	// InjectLegacyTrace keeps writing the `trace` field into json payloads
+	// for consumers which do not read trace headers yet
+	InjectLegacyTrace = true
+)
+
+type consumerTraceKey struct{}
+
+// consumerTraced marks ctx as within the span a MessageConsumer started for the message
+func consumerTraced(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consumerTraceKey{}, true)
+}
+
+func isConsumerTraced(ctx context.Context) bool {
+	traced, _ := ctx.Value(consumerTraceKey{}).(bool)
+	return traced
+}
+
+// HeadersCarrier adapts kafka headers to the otel TextMapCarrier
+type HeadersCarrier struct {
+	headers *[]kafka.Header
+}
+
+func NewHeadersCarrier(headers *[]kafka.Header) *HeadersCarrier {
+	return &HeadersCarrier{headers: headers}
+}
+
+// Get reads the last header of key, like HeaderValue
+func (c *HeadersCarrier) Get(key string) string {
+	value, _ := HeaderValue(&kafka.Message{Headers: *c.headers}, key)
+	return value
+}
+
+// Set replaces the last header of key, which is the one Get reads
+func (c *HeadersCarrier) Set(key, value string) {
+	for i := len(*c.headers) - 1; i >= 0; i-- {
+		if (*c.headers)[i].Key == key {
+			(*c.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.headers = append(*c.headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c *HeadersCarrier) Keys() []string {
+	keys := make([]string, len(*c.headers))
+	for i, h := range *c.headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// InjectTraceHeaders returns a copy of headers carrying the trace of ctx
+func InjectTraceHeaders(ctx context.Context, headers []kafka.Header) []kafka.Header {
+	result := make([]kafka.Header, len(headers))
+	copy(result, headers)
+	Propagator.Inject(ctx, NewHeadersCarrier(&result))
+	return result
+}
+
+// TraceFromMessageNamed continues the trace found in message headers,
+// payloads of legacy producers are searched for the `trace` field instead
+func TraceFromMessageNamed(ctx context.Context, msg *kafka.Message, name string) (context.Context, trace.Span) {
+	return traceFromHeadersNamed(ctx, msg.Headers, msg.Value, name)
+}
+
+func traceFromHeadersNamed(ctx context.Context, headers []kafka.Header, value []byte, name string) (context.Context, trace.Span) {
+	remoteCtx := Propagator.Extract(ctx, NewHeadersCarrier(&headers))
+	if trace.SpanContextFromContext(remoteCtx).IsRemote() {
+		return logging.StartSpan(remoteCtx, name)
+	}
+	return TraceFromEventNamed(remoteCtx, value, name)
+}
+
 type Trace struct {
 	TraceID    string `json:"traceId"`
 	SpanID     string `json:"spanId"`
@@ -72,6 +152,10 @@ func TraceFromEvent(ctx context.Context, event []byte) (context.Context, trace.S
 func TraceFromEventNamed(ctx context.Context, event []byte, name string) (context.Context, trace.Span) {
 	spanCtx, err := traceFromEventInternal(event)
 	if err != nil {
+		if trace.SpanContextFromContext(ctx).IsValid() {
+			// trace was already propagated by other means
+			return logging.StartSpan(ctx, name)
+		}
 		log := ctxlogrus.Extract(ctx)
 		log.Errorf("failed extracting trace from event %v", err)
 		return logging.StartSpan(ctx, name)
@@ -0,0 +1,103 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+)
+
+func TestHeadersCarrier(t *testing.T) {
+	headers := []kafka.Header{
+		{Key: "traceparent", Value: []byte("first")},
+		{Key: "tracestate", Value: []byte("vendor=1")},
+		{Key: "traceparent", Value: []byte("last")},
+	}
+	carrier := NewHeadersCarrier(&headers)
+
+	got := carrier.Get("traceparent")
+	want, _ := HeaderValue(&kafka.Message{Headers: headers}, "traceparent")
+	if got != want {
+		t.Errorf("TestHeadersCarrier(): Get of a repeated header\ngot= \t%v\nwant = \t%v", got, want)
+	}
+
+	carrier.Set("traceparent", "replaced")
+	carrier.Set("baggage", "tenant=acme")
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "traceparent", want: "replaced"},
+		{key: "tracestate", want: "vendor=1"},
+		{key: "baggage", want: "tenant=acme"},
+		{key: "missing", want: ""},
+	}
+	for _, tt := range tests {
+		if got := carrier.Get(tt.key); got != tt.want {
+			t.Errorf("TestHeadersCarrier(): Get %v\ngot= \t%v\nwant = \t%v", tt.key, got, tt.want)
+		}
+	}
+	if len(carrier.Keys()) != 4 {
+		t.Errorf("TestHeadersCarrier(): Keys\ngot= \t%v\nwant = \t%v", len(carrier.Keys()), 4)
+	}
+}
+
+func TestTraceFromMessage(t *testing.T) {
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), spanCtx)
+
+	tests := []struct {
+		name      string
+		msg       *kafka.Message
+		continued bool
+	}{
+		{
+			name:      "Trace headers",
+			msg:       &kafka.Message{Headers: InjectTraceHeaders(ctx, nil), Value: []byte(`{"type":"OrderPlaced"}`)},
+			continued: true,
+		},
+		{
+			name:      "Legacy trace field",
+			msg:       &kafka.Message{Value: enhanceWithCurrentTrace(ctx, []byte(`{"type":"OrderPlaced"}`))},
+			continued: true,
+		},
+		{
+			name:      "No trace",
+			msg:       &kafka.Message{Value: []byte(`{"type":"OrderPlaced"}`)},
+			continued: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			consumed, span := TraceFromMessageNamed(context.Background(), tt.msg, "EventConsumed")
+			defer span.End()
+
+			traceID := trace.SpanContextFromContext(consumed).TraceID()
+			if continued := traceID == spanCtx.TraceID(); continued != tt.continued {
+				t.Errorf("TestTraceFromMessage(): trace continued\ngot= \t%v\nwant = \t%v", continued, tt.continued)
+			}
+		})
+	}
+}
+
+func TestInjectTraceHeaders(t *testing.T) {
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{0x01},
+		SpanID:     trace.SpanID{0x02},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), spanCtx)
+	headers := []kafka.Header{{Key: "tenant", Value: []byte("acme")}}
+
+	injected := InjectTraceHeaders(ctx, headers)
+	if len(headers) != 1 {
+		t.Errorf("TestInjectTraceHeaders(): original headers\ngot= \t%v\nwant = \t%v", len(headers), 1)
+	}
+	if _, ok := HeaderValue(&kafka.Message{Headers: injected}, "traceparent"); !ok {
+		t.Errorf("TestInjectTraceHeaders(): traceparent\ngot= \t%v\nwant = \t%v", ok, true)
+	}
+}
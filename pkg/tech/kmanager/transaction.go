@@ -0,0 +1,26 @@
+package kmanager
+
+import (
+	"context"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+)
+
+// TxTopicHandler receives a transaction opened by the consumer. It is committed when the
+// handler succeeds and rolled back otherwise, so state changes and outbox rows written
+// with SendEvent or SendEvents are stored together before the offset is committed.
+type TxTopicHandler func(ctx context.Context, arguments *messaging.ContextualArguments,
+	tx *gorm.DB, msg *kafka.Message) error
+
+func Transactional(handler TxTopicHandler) TopicHandler {
+	return func(ctx context.Context, arguments *messaging.ContextualArguments, db *gorm.DB, msg *kafka.Message) error {
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return handler(ctx, arguments, tx, msg)
+		})
+	}
+}
+
+func (mc *MessageConsumer) StartTransactional(ctx context.Context, handleMessage TxTopicHandler) error {
+	return mc.Start(ctx, Transactional(handleMessage))
+}
@@ -0,0 +1,48 @@
+package kmanager
+
+import (
+	"context"
+	"errors"
+	"github.com/Cobalt0s/creme-brulee/pkg/rest/messaging"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"gorm.io/gorm"
+	"testing"
+)
+
+func TestTransactional(t *testing.T) {
+	tests := []struct {
+		name       string
+		handlerErr error
+	}{
+		{name: "Committed when the handler succeeds"},
+		{name: "Rolled back when the handler fails", handlerErr: errors.New("invoice already issued")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock := newMockDB(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(`INSERT INTO "outbox"`).
+				WithArgs("receipts", "42", `{"aggregateId":"42"}`, sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+				WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			if tt.handlerErr == nil {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			handler := Transactional(func(ctx context.Context, arguments *messaging.ContextualArguments, tx *gorm.DB, msg *kafka.Message) error {
+				if err := SendEvent(ctx, tx, "receipts", jsonEvent(`{"aggregateId":"42"}`)); err != nil {
+					return err
+				}
+				return tt.handlerErr
+			})
+			if err := handler(context.Background(), nil, db, &kafka.Message{}); err != tt.handlerErr {
+				t.Errorf("TestTransactional(): error\ngot= \t%v\nwant = \t%v", err, tt.handlerErr)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}